@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry records a single control write, successful or not
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Target    string    `json:"target"`
+	Model     string    `json:"model"`
+	Command   string    `json:"command"`
+	Register  uint16    `json:"register"`
+	Value     uint16    `json:"value"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog appends every control write to a JSON lines file, and to the log
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File // Nil if only logged
+}
+
+// newAuditLog opens the audit file for appending; an empty path logs the writes only
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+	return a, nil
+}
+
+// record logs the entry and appends it to the audit file
+func (a *auditLog) record(e auditEntry) {
+	if e.Error != "" {
+		log.Printf("Audit: command %s to %s (register %d = 0x%04x) from %s failed: %s", e.Command, e.Target, e.Register, e.Value, e.Remote, e.Error)
+	} else {
+		log.Printf("Audit: command %s sent to %s (register %d = 0x%04x) from %s", e.Command, e.Target, e.Register, e.Value, e.Remote)
+	}
+	if a.file == nil {
+		return
+	}
+
+	b, _ := json.Marshal(e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// runCheckConfig implements the check-config subcommand, validating the configuration file
+// and the register map of every target without connecting to any controller. Every problem
+// found is printed, and the exit status is non-zero if there is any, for CI pipelines.
+func runCheckConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	model := fs.String("device.model", getEnv("DATAKOM_MODEL", "d500"), "Controller model of targets without one (d300, d500, d700, dkg507, dkg509)")
+	configFile := fs.String("config.file", getEnv("DATAKOM_CONFIG", ""), "Path to the YAML configuration file")
+	fs.Parse(args)
+
+	name := *configFile
+	if name == "" {
+		name = "default configuration"
+	}
+	errs, targets := checkConfig(*configFile, *model)
+	if len(errs) > 0 {
+		problems := "problems"
+		if len(errs) == 1 {
+			problems = "problem"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d %s found\n", name, len(errs), problems)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  - %v\n", err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK (%d targets)\n", name, targets)
+}
+
+// checkConfig returns the problems of the configuration file and the number of targets
+// checked. Each distinct register map is checked once, reported under its first target.
+func checkConfig(configFile, model string) ([]error, int) {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return []error{err}, 0
+	}
+
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		fail("labels: %v", err)
+	}
+
+	targets := cfg.Targets
+	if len(targets) == 0 && cfg.Discovery == nil {
+		port, err := strconv.Atoi(getEnv("DATAKOM_PORT", "502"))
+		if err != nil {
+			fail("invalid DATAKOM_PORT: %v", err)
+		}
+		targets = []TargetConfig{{Host: getEnv("DATAKOM_HOST", "192.168.100.100"), Port: port}}
+	}
+	names := make(map[string]bool)
+	checked := make(map[string]bool)
+	for i, t := range targets {
+		collector, err := newTargetCollector(t, cfg, model)
+		if err != nil {
+			where := t.Host
+			if t.Serial != nil {
+				where = t.Serial.Device
+			}
+			fail("target %d (%s): %v", i+1, where, err)
+			continue
+		}
+		if names[collector.Name()] {
+			fail("target %s: defined more than once", collector.Name())
+		}
+		names[collector.Name()] = true
+		if err := validateLabels(t.Labels); err != nil {
+			fail("target %s: %v", collector.Name(), err)
+		}
+
+		profile := collector.Profile()
+		if key := fingerprint(profile.Model, t.Blocks); !checked[key] {
+			checked[key] = true
+			for _, err := range profile.Check() {
+				fail("target %s (model %s): %v", collector.Name(), profile.Model, err)
+			}
+		}
+	}
+
+	if cfg.Discovery != nil {
+		if _, err := newDiscoverer(*cfg.Discovery, cfg, model, nil, newTargetSet()); err != nil {
+			fail("discovery: %v", err)
+		}
+	}
+	if cfg.MQTT != nil {
+		if err := cfg.MQTT.validate(); err != nil {
+			fail("mqtt: %v", err)
+		}
+	}
+	if cfg.Influx != nil {
+		if err := cfg.Influx.validate(); err != nil {
+			fail("influx: %v", err)
+		}
+	}
+	if cfg.OTLP != nil {
+		if err := cfg.OTLP.validate(); err != nil {
+			fail("otlp: %v", err)
+		}
+	}
+	if cfg.RemoteWrite != nil {
+		if err := cfg.RemoteWrite.validate(); err != nil {
+			fail("remote_write: %v", err)
+		}
+	}
+	if cfg.History != nil {
+		if err := cfg.History.validate(); err != nil {
+			fail("history: %v", err)
+		}
+	}
+	if cfg.Notify != nil {
+		if err := cfg.Notify.validate(); err != nil {
+			fail("notify: %v", err)
+		}
+	}
+	return errs, len(targets)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"go.yaml.in/yaml/v2"
+)
+
+// Config is the optional YAML configuration file
+type Config struct {
+	Blocks       []datakom.BlockConfig       `yaml:"blocks"`
+	AnalogInputs []datakom.AnalogInputConfig `yaml:"analog_inputs"`
+	Timezone     string                      `yaml:"timezone"` // Zone of the controller clock, defaults to the host zone
+	Labels       map[string]string           `yaml:"labels"`   // Constant labels attached to all device metrics
+	Targets      []TargetConfig              `yaml:"targets"`
+	Discovery    *DiscoveryConfig            `yaml:"discovery"`
+	MQTT         *MQTTConfig                 `yaml:"mqtt"`
+	Influx       *InfluxConfig               `yaml:"influx"`
+	OTLP         *OTLPConfig                 `yaml:"otlp"`
+	RemoteWrite  *RemoteWriteConfig          `yaml:"remote_write"`
+	History      *HistoryConfig              `yaml:"history"`
+	Notify       *NotifyConfig               `yaml:"notify"`
+	Retry        datakom.RetryPolicy         `yaml:"retry"`
+	Units        datakom.UnitConfig          `yaml:"units"`
+	Rating       datakom.RatingConfig        `yaml:"rating"`  // Rated power of the gensets, for the load percentage
+	Fuel         datakom.FuelConfig          `yaml:"fuel"`    // Fuel tank and rate settings of the gensets
+	Service      datakom.ServiceConfig       `yaml:"service"` // When maintenance of the gensets is due
+	Modbus       ModbusConfig                `yaml:"modbus"`
+	Watchdog     WatchdogConfig              `yaml:"watchdog"`
+
+	// Texts of register codes by register name, e.g. op_status, merged over those of the file
+	StatusCodes     map[string]map[int]string `yaml:"status_codes"`
+	StatusCodesFile string                    `yaml:"status_codes_file"`
+}
+
+// TargetConfig describes one controller polled by the exporter
+type TargetConfig struct {
+	Name   string            `yaml:"name"` // Value of the target label, defaults to host:port
+	Host   string            `yaml:"host"`
+	Port   int               `yaml:"port"`    // Defaults to 502
+	UnitID uint8             `yaml:"unit_id"` // Defaults to 1
+	Model  string            `yaml:"model"`   // Defaults to --device.model
+	Labels map[string]string `yaml:"labels"`  // Merged over the global labels
+
+	Blocks  []datakom.BlockConfig  `yaml:"blocks"`  // Applied over the global block overrides
+	Rating  *datakom.RatingConfig  `yaml:"rating"`  // Overrides the global rating
+	Fuel    *datakom.FuelConfig    `yaml:"fuel"`    // Overrides the global fuel settings
+	Service *datakom.ServiceConfig `yaml:"service"` // Overrides the global service settings
+	Retry   *datakom.RetryPolicy   `yaml:"retry"`   // Overrides the global retry policy
+	Modbus  *ModbusConfig          `yaml:"modbus"`  // Applied over the global Modbus settings
+	TLS     *TLSConfig             `yaml:"tls"`     // Connects with Modbus/TCP Security, on port 802 by default
+	Serial  *SerialConfig          `yaml:"serial"`  // Polls the controller on a serial line instead of a host
+
+	Watchdog *WatchdogConfig `yaml:"watchdog"` // Overrides the global watchdog, e.g. with the webhook of its router
+}
+
+// TLSConfig sets the client certificate and trusted CAs of a Modbus/TCP Security connection
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"` // PEM client certificate, required by the protocol
+	KeyFile  string `yaml:"key_file"`  // PEM private key of the client certificate
+	CAFile   string `yaml:"ca_file"`   // PEM CAs or pinned server certificates, defaults to the system roots
+}
+
+// SerialConfig sets the port and framing of a controller on an RS-232 or RS-485 line
+type SerialConfig struct {
+	Device   string `yaml:"device"`    // e.g. /dev/ttyUSB0
+	Framing  string `yaml:"framing"`   // rtu (default) or ascii
+	Baud     int    `yaml:"baud"`      // Defaults to 9600
+	DataBits int    `yaml:"data_bits"` // Defaults to 8 for RTU and 7 for ASCII
+	Parity   string `yaml:"parity"`    // none (default), even or odd
+	StopBits int    `yaml:"stop_bits"` // Defaults to 2 without parity and 1 with it
+}
+
+// ModbusConfig tunes the Modbus requests polling the controllers; settings of a target
+// left unset fall back to the global ones
+type ModbusConfig struct {
+	Timeout      time.Duration `yaml:"timeout"`       // Connect and response timeout, defaults to 5s
+	RequestDelay time.Duration `yaml:"request_delay"` // Pause between consecutive requests, none by default
+	MinInterval  time.Duration `yaml:"min_interval"`  // Minimum time between polls, scrapes within it get the last reading
+	MaxGap       *uint16       `yaml:"max_gap"`       // Unused registers a read may span to merge blocks, defaults to 16
+	MaxReadSize  uint16        `yaml:"max_read_size"` // Registers per read, at most and by default 125
+}
+
+// merge returns the settings with those set by the target applied over them
+func (m ModbusConfig) merge(t *ModbusConfig) ModbusConfig {
+	if t == nil {
+		return m
+	}
+	if t.Timeout != 0 {
+		m.Timeout = t.Timeout
+	}
+	if t.RequestDelay != 0 {
+		m.RequestDelay = t.RequestDelay
+	}
+	if t.MinInterval != 0 {
+		m.MinInterval = t.MinInterval
+	}
+	if t.MaxGap != nil {
+		m.MaxGap = t.MaxGap
+	}
+	if t.MaxReadSize != 0 {
+		m.MaxReadSize = t.MaxReadSize
+	}
+	return m
+}
+
+// DiscoveryConfig enables scanning networks for controllers answering Modbus
+type DiscoveryConfig struct {
+	Networks    []string          `yaml:"networks"`    // CIDR ranges to scan, at most /16 each
+	Port        int               `yaml:"port"`        // Defaults to 502
+	UnitID      uint8             `yaml:"unit_id"`     // Defaults to 1
+	Interval    time.Duration     `yaml:"interval"`    // Time between scans, defaults to 10m; a scan must fit within it
+	Timeout     time.Duration     `yaml:"timeout"`     // Connect and read timeout per address, defaults to 1s
+	Concurrency int               `yaml:"concurrency"` // Parallel probes, defaults to 32
+	Labels      map[string]string `yaml:"labels"`      // Merged over the global labels
+}
+
+// MQTTConfig enables publishing the polled readings to an MQTT broker
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`    // e.g. tcp://broker:1883 or ssl://broker:8883
+	ClientID string `yaml:"client_id"` // Defaults to datakom-exporter
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Topic    string `yaml:"topic"`  // Topic prefix, defaults to datakom
+	Mode     string `yaml:"mode"`   // "reading" (one document per poll, default) or "metric" (one payload per series)
+	QoS      byte   `yaml:"qos"`    // 0, 1 or 2
+	Retain   bool   `yaml:"retain"` // Publish retained messages
+}
+
+// InfluxConfig enables pushing the polled readings in InfluxDB line protocol
+type InfluxConfig struct {
+	URL      string        `yaml:"url"`   // Write endpoint, e.g. http://influxdb:8086/api/v2/write?org=ops&bucket=datakom
+	Token    string        `yaml:"token"` // InfluxDB 2.x API token
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Timeout  time.Duration `yaml:"timeout"` // Defaults to 10s
+}
+
+// OTLPConfig enables exporting the polled readings to an OpenTelemetry collector
+type OTLPConfig struct {
+	Endpoint           string            `yaml:"endpoint"` // OTLP/HTTP metrics endpoint, e.g. http://otel-collector:4318/v1/metrics
+	Headers            map[string]string `yaml:"headers"`  // e.g. Authorization
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+	Timeout            time.Duration     `yaml:"timeout"` // Defaults to 10s
+}
+
+// RemoteWriteConfig enables pushing the polled readings over Prometheus remote write
+type RemoteWriteConfig struct {
+	URL         string            `yaml:"url"` // e.g. https://prometheus.example.com/api/v1/write
+	Username    string            `yaml:"username"`
+	Password    string            `yaml:"password"`
+	BearerToken string            `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	Timeout     time.Duration     `yaml:"timeout"`     // Defaults to 30s
+	MaxPending  int               `yaml:"max_pending"` // Unsent readings kept for retrying, defaults to 100
+}
+
+// HistoryConfig enables keeping the polled readings of the last hours in memory, served on
+// /api/v1/history, and optionally in a file surviving restarts
+type HistoryConfig struct {
+	Retention time.Duration `yaml:"retention"` // Defaults to 24h
+	File      string        `yaml:"file"`      // Readings are appended as JSON lines, if set
+}
+
+// loadConfig reads and parses the configuration file; an empty path yields an empty config
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cfg.StatusCodesFile != "" {
+		if err := loadStatusCodes(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// loadStatusCodes reads the code texts of the status codes file into the config, keeping
+// the texts of registers set in the config file itself
+func loadStatusCodes(cfg *Config) error {
+	data, err := os.ReadFile(cfg.StatusCodesFile)
+	if err != nil {
+		return err
+	}
+	var codes map[string]map[int]string
+	if err := yaml.UnmarshalStrict(data, &codes); err != nil {
+		return fmt.Errorf("parsing %s: %w", cfg.StatusCodesFile, err)
+	}
+	if codes == nil {
+		codes = make(map[string]map[int]string) // Empty file
+	}
+	for name, texts := range cfg.StatusCodes {
+		codes[name] = texts
+	}
+	cfg.StatusCodes = codes
+	return nil
+}
+
+// parseLabels parses a comma separated list of name=value pairs, e.g. "site=kyiv,genset_name=gen-1"
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// validateLabels checks that all constant label names are valid Prometheus label names
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// configureProfile returns a copy of the profile with the register overrides, analog inputs,
+// timezone, code texts and units of the config applied, and the block overrides of the target
+func configureProfile(p *datakom.DeviceProfile, cfg *Config, blocks []datakom.BlockConfig) (*datakom.DeviceProfile, error) {
+	var loc *time.Location
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	p, err := p.Configure(append(slices.Clone(cfg.Blocks), blocks...), cfg.AnalogInputs, loc)
+	if err != nil {
+		return nil, err
+	}
+	if p, err = p.MapCodes(cfg.StatusCodes); err != nil {
+		return nil, err
+	}
+	return p.ConvertUnits(cfg.Units)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// loadControlToken returns the token authorizing control commands, read from the file if
+// set and otherwise from EXPORTER_CONTROL_TOKEN; empty if control commands are disabled
+func loadControlToken(file string) (string, error) {
+	if file == "" {
+		return getEnv("EXPORTER_CONTROL_TOKEN", ""), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// authorize passes requests carrying the bearer token on to the handler
+func authorize(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="datakom_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// controlAPI issues control writes to the controllers, auditing every one of them
+type controlAPI struct {
+	audit *auditLog
+}
+
+// Alarm actions of /api/v1/alarms, mirroring the front panel buttons
+var alarmActions = map[string]string{
+	"acknowledge": "mute_horn",
+	"reset":       "reset_alarms",
+}
+
+// serveControl lists the commands of the controller on GET, and issues the one named
+// by ?command=<name> on POST, e.g. POST /api/v1/control?target=genset-1&command=start
+func (a *controlAPI) serveControl(c *datakom.Collector, w http.ResponseWriter, req *http.Request) {
+	commands := c.Profile().Commands
+	switch req.Method {
+	case http.MethodGet:
+		help := make(map[string]string, len(commands))
+		for name, cmd := range commands {
+			help[name] = cmd.Help
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Target   string            `json:"target"`
+			Commands map[string]string `json:"commands"`
+		}{c.Name(), help})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Only GET or POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := req.URL.Query().Get("command")
+	if _, ok := commands[name]; !ok {
+		http.Error(w, fmt.Sprintf("unsupported command %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(commands)), ", ")), http.StatusBadRequest)
+		return
+	}
+	a.send(c, name, w, req)
+}
+
+// serveAlarms acknowledges (mutes the horn) or resets the latched alarms on
+// POST /api/v1/alarms?action=acknowledge|reset
+func (a *controlAPI) serveAlarms(c *datakom.Collector, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action := req.URL.Query().Get("action")
+	name, ok := alarmActions[action]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported action %q, expected acknowledge or reset", action), http.StatusBadRequest)
+		return
+	}
+	if _, ok := c.Profile().Commands[name]; !ok {
+		http.Error(w, "alarm "+action+" not supported by model "+c.Profile().Model, http.StatusNotFound)
+		return
+	}
+	a.send(c, name, w, req)
+}
+
+// send issues a command of the controller's profile and records it in the audit log
+func (a *controlAPI) send(c *datakom.Collector, name string, w http.ResponseWriter, req *http.Request) {
+	cmd := c.Profile().Commands[name]
+	entry := auditEntry{
+		Time:      time.Now(),
+		Remote:    req.RemoteAddr,
+		UserAgent: req.UserAgent(),
+		Target:    c.Name(),
+		Model:     c.Profile().Model,
+		Command:   name,
+		Register:  cmd.Address,
+		Value:     cmd.Value,
+	}
+	err := c.Command(name)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.audit.record(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "command %s sent to %s\n", name, c.Name())
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// Dashboard rows, in the order they are laid out
+var dashboardRows = []string{"Electrical", "Engine", "Fuel", "Status & Alarms", "Other"}
+
+// Grafana units of the register units
+var grafanaUnits = map[string]string{
+	"V": "volt", "A": "amp", "kW": "kwatt", "kWh": "kwatth", "Hz": "hertz", "°C": "celsius", "°F": "fahrenheit",
+	"%": "percent", "°": "degree", "s": "s", "h": "h", "d": "d", "dBm": "dBm", "W": "watt", "J": "joule", "m": "lengthm",
+}
+
+// dashboardPanel is a metric shown in the dashboard
+type dashboardPanel struct {
+	name   string // Metric name without the model prefix
+	help   string
+	unit   string
+	labels []string // Variable labels, shown in the legend
+	stat   bool     // Shown as the current value rather than over time, for states and counts
+	geomap bool     // Placed on a map by its latitude and longitude labels
+}
+
+// runDashboard implements the dashboard subcommand, printing a Grafana dashboard for the
+// register map of a model with the register overrides and analog inputs of the config
+func runDashboard(args []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	model := fs.String("device.model", getEnv("DATAKOM_MODEL", "d500"), "Controller model (d300, d500, d700, dkg507, dkg509)")
+	configFile := fs.String("config.file", getEnv("DATAKOM_CONFIG", ""), "Path to the optional YAML configuration file")
+	title := fs.String("title", "", "Dashboard title, defaults to Datakom <model>")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	profile, err := datakom.Lookup(*model)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if profile, err = configureProfile(profile, cfg, nil); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *title == "" {
+		*title = "Datakom " + strings.ToUpper(profile.Model)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dashboard(profile, *title)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dashboardPanels returns the panels of the profile's metrics by row
+func dashboardPanels(p *datakom.DeviceProfile) map[string][]dashboardPanel {
+	rows := make(map[string][]dashboardPanel)
+	seen := make(map[string]bool)
+	add := func(panel dashboardPanel) {
+		if seen[panel.name] {
+			return
+		}
+		seen[panel.name] = true
+		row := dashboardRow(panel.name)
+		rows[row] = append(rows[row], panel)
+	}
+
+	for _, b := range p.Blocks {
+		for _, r := range b.Registers {
+			panel := dashboardPanel{name: r.Name, help: r.Help, unit: r.Unit(), stat: r.Counter || r.Mask != 0 || r.InfoLabel != "" || strings.HasSuffix(r.Name, "_status")}
+			for _, l := range r.Labels {
+				panel.labels = append(panel.labels, l.Name)
+			}
+			if r.InfoLabel != "" {
+				panel.labels = append(panel.labels, r.InfoLabel)
+			}
+			add(panel)
+			if r.Codes != nil {
+				add(dashboardPanel{name: r.Name + "_info", help: r.Help + ", as text", labels: append(panel.labels, "text"), stat: true})
+			}
+		}
+	}
+	if p.Power != "" {
+		add(dashboardPanel{name: "load_percent", help: "Genset active power relative to its rated power", unit: "%"})
+	}
+	if p.FuelLevel != "" {
+		rate, runtime, unit := "fuel_rate_percent_per_hour", "fuel_runtime_remaining_hours", "h"
+		if p.BaseUnits {
+			rate, runtime, unit = "fuel_rate_percent_per_second", "fuel_runtime_remaining_seconds", "s"
+		}
+		add(dashboardPanel{name: rate, help: "Fuel consumption rate, relative to the tank capacity", unit: "%/" + unit})
+		add(dashboardPanel{name: runtime, help: "Estimated remaining runtime at the current fuel consumption rate", unit: unit, stat: true})
+	}
+	if p.Latitude != "" && p.Longitude != "" {
+		add(dashboardPanel{name: "location_info", help: "GPS position of the genset", labels: []string{"latitude", "longitude"}, geomap: true})
+	}
+	add(dashboardPanel{name: "block_read_success", help: "Whether the last read of the register block succeeded", labels: []string{"block"}, stat: true})
+	return rows
+}
+
+// dashboardRow places a metric in a row of the dashboard by its name
+func dashboardRow(name string) string {
+	has := func(parts ...string) bool {
+		for _, p := range parts {
+			if strings.Contains(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("fuel"):
+		return "Fuel"
+	case has("gsm", "gps", "location", "clock", "event"):
+		return "Other"
+	case has("status", "alarm", "warning", "shutdown", "contactor", "breaker", "ats_", "digital_input", "relay_output", "block_read"):
+		return "Status & Alarms"
+	case has("engine", "battery", "oil", "coolant", "rpm", "run_", "service", "crank"):
+		return "Engine"
+	case has("mains", "genset", "gen_", "bus_", "sync_", "voltage", "current", "power", "energy", "load", "freq"):
+		return "Electrical"
+	}
+	return "Other"
+}
+
+// dashboard builds the Grafana dashboard model of the profile
+func dashboard(p *datakom.DeviceProfile, title string) map[string]any {
+	const width, height, perRow = 8, 8, 3
+	datasource := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+	rows := dashboardPanels(p)
+
+	var panels []map[string]any
+	id, y := 1, 0
+	for _, row := range dashboardRows {
+		if len(rows[row]) == 0 {
+			continue
+		}
+		panels = append(panels, map[string]any{
+			"id": id, "type": "row", "title": row, "collapsed": false,
+			"gridPos": map[string]int{"x": 0, "y": y, "w": 24, "h": 1},
+		})
+		id, y = id+1, y+1
+		for i, panel := range rows[row] {
+			legend := "{{target}}"
+			for _, l := range panel.labels {
+				legend += " {{" + l + "}}"
+			}
+			kind := "timeseries"
+			if panel.stat {
+				kind = "stat"
+			}
+			unit := grafanaUnits[panel.unit]
+			if unit == "" && panel.unit != "" {
+				unit = "suffix:" + panel.unit
+			}
+			query := map[string]any{
+				"refId": "A", "datasource": datasource, "legendFormat": strings.TrimSpace(legend),
+				"expr": fmt.Sprintf(`%s_%s{target=~"$target"}`, p.Prefix, panel.name),
+			}
+			model := map[string]any{
+				"id": id, "type": kind, "title": panel.name, "description": panel.help, "datasource": datasource,
+				"gridPos":     map[string]int{"x": (i % perRow) * width, "y": y + (i/perRow)*height, "w": width, "h": height},
+				"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+				"targets":     []map[string]any{query},
+			}
+			if panel.geomap {
+				// A marker per target at the coordinates of its labels, converted to numbers
+				model["type"] = "geomap"
+				query["format"], query["instant"] = "table", true
+				model["transformations"] = []map[string]any{{"id": "convertFieldType", "options": map[string]any{
+					"conversions": []map[string]string{
+						{"targetField": "latitude", "destinationType": "number"},
+						{"targetField": "longitude", "destinationType": "number"},
+					},
+				}}}
+				model["options"] = map[string]any{
+					"view": map[string]string{"id": "fit"},
+					"layers": []map[string]any{{
+						"type": "markers", "name": "Gensets",
+						"location": map[string]string{"mode": "coords", "latitude": "latitude", "longitude": "longitude"},
+					}},
+				}
+			}
+			panels = append(panels, model)
+			id++
+		}
+		y += (len(rows[row]) + perRow - 1) / perRow * height
+	}
+
+	return map[string]any{
+		"title":         title,
+		"uid":           "datakom-" + p.Model,
+		"tags":          []string{"datakom", p.Model},
+		"schemaVersion": 39,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]any{"list": []map[string]any{
+			{"name": "datasource", "type": "datasource", "query": "prometheus", "label": "Data source"},
+			{
+				"name": "target", "type": "query", "label": "Target", "datasource": datasource,
+				"query":      fmt.Sprintf("label_values(%s_block_read_success, target)", p.Prefix),
+				"includeAll": true, "allValue": ".*", "multi": true, "refresh": 2,
+				"current": map[string]any{"text": "All", "value": "$__all"},
+			},
+		}},
+		"panels": panels,
+	}
+}
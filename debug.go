@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// Maximum number of registers in a single Modbus read request
+const maxReadCount = 125
+
+// serveRegisters performs an ad-hoc register read and lists the raw values in hex and decimal,
+// e.g. /debug/registers?start=10240&count=50&type=holding
+func serveRegisters(c *datakom.Collector, w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	start, err := strconv.ParseUint(q.Get("start"), 10, 16)
+	if err != nil {
+		http.Error(w, "invalid start address", http.StatusBadRequest)
+		return
+	}
+	count := uint64(1)
+	if v := q.Get("count"); v != "" {
+		if count, err = strconv.ParseUint(v, 10, 16); err != nil || count < 1 || count > maxReadCount {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxReadCount), http.StatusBadRequest)
+			return
+		}
+	}
+	if start+count > 1<<16 {
+		http.Error(w, "read exceeds the register address space", http.StatusBadRequest)
+		return
+	}
+
+	regType, typeName := modbus.HOLDING_REGISTER, "holding"
+	switch q.Get("type") {
+	case "", "holding":
+	case "input":
+		regType, typeName = modbus.INPUT_REGISTER, "input"
+	default:
+		http.Error(w, "type must be holding or input", http.StatusBadRequest)
+		return
+	}
+
+	var regs []uint16
+	err = c.Session(func() (err error) {
+		regs, err = c.ReadRegisters("debug", uint16(start), uint16(count), regType)
+		return err
+	})
+	if err != nil {
+		log.Printf("Debug read of %d registers at %d from %s failed: %v", count, start, c.Name(), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# %s registers %d-%d from %s\n", typeName, start, start+uint64(len(regs))-1, c.Name())
+	fmt.Fprintf(w, "%-8s %-8s %-8s %s\n", "address", "hex", "uint16", "int16")
+	for i, v := range regs {
+		fmt.Fprintf(w, "%-8d 0x%04X   %-8d %d\n", start+uint64(i), v, v, int16(v))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// Largest network accepted for scanning, in host address bits
+const maxDiscoveryHostBits = 16
+
+// discoverer periodically scans networks for Datakom controllers and keeps the
+// target set in sync with the controllers found
+type discoverer struct {
+	dc           DiscoveryConfig
+	cfg          *Config
+	defaultModel string
+	labels       map[string]string // Constant labels of discovered targets
+	static       map[string]bool   // host:port of configured targets, never probed
+	set          *targetSet
+
+	networks   []netip.Prefix
+	discovered map[string]bool // Names of the targets added by discovery
+
+	// Stopping removes the discovered targets; a scan in progress finishes without effect
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+// newDiscoverer validates the discovery configuration and applies its defaults
+func newDiscoverer(dc DiscoveryConfig, cfg *Config, defaultModel string, labels map[string]string, set *targetSet) (*discoverer, error) {
+	if len(dc.Networks) == 0 {
+		return nil, fmt.Errorf("no networks configured")
+	}
+	if dc.Port == 0 {
+		dc.Port = 502
+	}
+	if dc.UnitID == 0 {
+		dc.UnitID = 1
+	}
+	if dc.Interval == 0 {
+		dc.Interval = 10 * time.Minute
+	}
+	if dc.Timeout == 0 {
+		dc.Timeout = time.Second
+	}
+	if dc.Concurrency == 0 {
+		dc.Concurrency = 32
+	}
+	if dc.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+
+	d := &discoverer{
+		dc:           dc,
+		cfg:          cfg,
+		defaultModel: defaultModel,
+		labels:       labels,
+		static:       make(map[string]bool),
+		set:          set,
+		discovered:   make(map[string]bool),
+		done:         make(chan struct{}),
+	}
+	addresses := 0
+	for _, n := range dc.Networks {
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().BitLen()-p.Bits() > maxDiscoveryHostBits {
+			return nil, fmt.Errorf("network %s is larger than /%d", n, p.Addr().BitLen()-maxDiscoveryHostBits)
+		}
+		d.networks = append(d.networks, p.Masked())
+		addresses += 1 << (p.Addr().BitLen() - p.Bits())
+	}
+	// Scans run back to back, so one lasting longer than the interval would leave gone
+	// controllers polled and new ones unnoticed for longer than configured
+	if scan := time.Duration((addresses+dc.Concurrency-1)/dc.Concurrency) * dc.Timeout; scan > dc.Interval {
+		return nil, fmt.Errorf("scanning %d addresses takes up to %s at a timeout of %s and a concurrency of %d, longer than the interval of %s; scan smaller networks, or raise the concurrency or the interval",
+			addresses, scan, dc.Timeout, dc.Concurrency, dc.Interval)
+	}
+	for _, t := range cfg.Targets {
+		if t.Serial != nil {
+			continue
+		}
+		port := t.Port
+		if port == 0 {
+			port = 502
+			if t.TLS != nil {
+				port = 802
+			}
+		}
+		d.static[net.JoinHostPort(hostname(t.Host), strconv.Itoa(port))] = true
+	}
+	return d, nil
+}
+
+// run scans the networks immediately and then an interval after each scan finished, until stopped
+func (d *discoverer) run() {
+	for {
+		d.scan()
+		select {
+		case <-time.After(d.dc.Interval):
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// stop ends discovery and removes the discovered targets
+func (d *discoverer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isStopped() {
+		return
+	}
+	close(d.done)
+	for name := range d.discovered {
+		d.set.remove(name)
+	}
+}
+
+// isStopped reports whether stop was called
+func (d *discoverer) isStopped() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// scan probes every address of the networks, registering newly found controllers
+// and removing discovered targets that no longer answer
+func (d *discoverer) scan() {
+	start := time.Now()
+	var mu sync.Mutex
+	found := make(map[string]*datakom.DeviceProfile)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, d.dc.Concurrency)
+	for _, n := range d.networks {
+		for a := n.Addr(); n.Contains(a); a = a.Next() {
+			// Skip the IPv4 network and broadcast addresses
+			if a.Is4() && n.Bits() < 31 && (a == n.Addr() || !n.Contains(a.Next())) {
+				continue
+			}
+			addr := net.JoinHostPort(a.String(), strconv.Itoa(d.dc.Port))
+			if d.static[addr] {
+				continue
+			}
+			if d.isStopped() {
+				break
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				if p := d.probe(addr); p != nil {
+					mu.Lock()
+					found[addr] = p
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isStopped() {
+		return
+	}
+	for name := range d.discovered {
+		if _, ok := found[name]; !ok {
+			log.Printf("Discovered target %s no longer answers, removing it", name)
+			d.set.remove(name)
+			delete(d.discovered, name)
+		}
+	}
+	for _, addr := range slices.Sorted(maps.Keys(found)) {
+		if d.discovered[addr] {
+			if t := d.set.get(addr); t != nil && t.collector.Profile().Model == found[addr].Model {
+				continue
+			}
+			// A different controller model took over the address
+			d.set.remove(addr)
+			delete(d.discovered, addr)
+		}
+		if err := d.add(addr, found[addr]); err != nil {
+			log.Printf("Failed to add discovered target %s: %v", addr, err)
+			continue
+		}
+		d.discovered[addr] = true
+		log.Printf("Discovered target %s (Model: %s)", addr, found[addr].Model)
+	}
+	log.Printf("Discovery scan finished in %s: %d controllers", time.Since(start).Round(time.Second), len(d.discovered))
+}
+
+// probe returns the profile of the controller answering at addr, or nil. Controllers
+// already polled are checked over their existing connection, as they accept only one.
+func (d *discoverer) probe(addr string) *datakom.DeviceProfile {
+	if d.discovered[addr] {
+		t := d.set.get(addr)
+		if t == nil {
+			return nil
+		}
+		p, _ := t.collector.Identify()
+		return p
+	}
+
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{
+		URL: "tcp://" + addr, Timeout: d.dc.Timeout,
+	})
+	if err != nil {
+		return nil
+	}
+	if err := client.Open(); err != nil {
+		return nil
+	}
+	defer client.Close()
+	client.SetUnitId(d.dc.UnitID)
+	return datakom.Identify(client)
+}
+
+// add registers a collector for a discovered controller
+func (d *discoverer) add(addr string, p *datakom.DeviceProfile) error {
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	c, err := newTargetCollector(TargetConfig{Name: addr, Host: host, Port: portNum, UnitID: d.dc.UnitID, Model: p.Model}, d.cfg, d.defaultModel)
+	if err != nil {
+		return err
+	}
+	labels := maps.Clone(d.labels)
+	labels["target"] = addr
+	return d.set.add(c, labels)
+}
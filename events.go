@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// serveEvents returns the controller's event log as JSON, optionally limited with ?limit=N
+func serveEvents(c *datakom.Collector, w http.ResponseWriter, req *http.Request) {
+	l := c.Profile().EventLog
+	if l.Capacity == 0 {
+		http.Error(w, "event log not supported by model "+c.Profile().Model, http.StatusNotFound)
+		return
+	}
+
+	limit := l.Capacity
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	total, events, err := c.Events(limit)
+	if err != nil {
+		log.Printf("Failed to read event log from %s: %v", c.Name(), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Target string          `json:"target"`
+		Total  uint32          `json:"total"`
+		Events []datakom.Event `json:"events"`
+	}{c.Name(), total, events})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// exporter applies the configuration to the target set, initially and on every reload.
+// Targets whose configuration is unchanged keep their collector, so their polling and
+// Modbus client carry on undisturbed.
+type exporter struct {
+	configFile   string
+	defaultModel string
+	set          *targetSet
+
+	quit     chan struct{} // Closed on POST /-/quit
+	quitOnce sync.Once
+
+	mu      sync.Mutex
+	outputs *Config           // Outputs and polling of the initial configuration, not reloadable
+	keys    map[string]string // Fingerprints of the configured targets by name
+	disc    *discoverer       // Running discovery, if configured
+	discKey string            // Fingerprint of the running discovery
+}
+
+func newExporter(configFile, defaultModel string, set *targetSet) *exporter {
+	return &exporter{configFile: configFile, defaultModel: defaultModel, set: set, quit: make(chan struct{}), keys: make(map[string]string)}
+}
+
+// fingerprint returns a comparable encoding of the values that shape a collector
+func fingerprint(v ...any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// reload loads the configuration file again and applies it; the running configuration
+// is kept if the file is invalid
+func (e *exporter) reload() error {
+	cfg, err := loadConfig(e.configFile)
+	if err != nil {
+		return err
+	}
+	return e.apply(cfg)
+}
+
+// apply brings the targets and discovery in line with the configuration. The configuration
+// is validated as a whole before any target is changed.
+func (e *exporter) apply(cfg *Config) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.outputs == nil {
+		e.outputs = cfg
+	} else if !reflect.DeepEqual([]any{cfg.MQTT, cfg.Influx, cfg.OTLP, cfg.RemoteWrite, cfg.History, cfg.Notify},
+		[]any{e.outputs.MQTT, e.outputs.Influx, e.outputs.OTLP, e.outputs.RemoteWrite, e.outputs.History, e.outputs.Notify}) {
+		log.Printf("Output configuration changes take effect after a restart")
+	}
+
+	// Constant labels from the config file, overridden by the environment
+	labels := make(map[string]string)
+	for name, value := range cfg.Labels {
+		labels[name] = value
+	}
+	if v := getEnv("DATAKOM_LABELS", ""); v != "" {
+		envLabels, err := parseLabels(v)
+		if err != nil {
+			return fmt.Errorf("invalid DATAKOM_LABELS: %w", err)
+		}
+		for name, value := range envLabels {
+			labels[name] = value
+		}
+	}
+
+	// Without configured or discovered targets, a single controller is taken from the environment
+	targets := cfg.Targets
+	multiTarget := len(targets) > 0 || cfg.Discovery != nil
+	if !multiTarget {
+		port, err := strconv.Atoi(getEnv("DATAKOM_PORT", "502"))
+		if err != nil {
+			return fmt.Errorf("invalid DATAKOM_PORT: %w", err)
+		}
+		targets = []TargetConfig{{Host: getEnv("DATAKOM_HOST", "192.168.100.100"), Port: port}}
+	}
+
+	// Discovered targets share the label names of the configured ones
+	labelSets := mergeTargetLabels(labels, targets)
+	if cfg.Discovery != nil {
+		labelSets = mergeTargetLabels(labels, append(targets, TargetConfig{Labels: cfg.Discovery.Labels}))
+	}
+	profileKey := fingerprint(cfg.Blocks, cfg.AnalogInputs, cfg.Timezone, cfg.Units, cfg.Retry, cfg.Rating, cfg.Fuel, cfg.Service, cfg.Modbus, cfg.Watchdog, cfg.StatusCodes, e.defaultModel)
+
+	// Build the collectors of all configured targets, keeping the unchanged ones
+	type pending struct {
+		collector *datakom.Collector
+		labels    map[string]string
+	}
+	var added []pending
+	keys := make(map[string]string)
+	for i, labels := range labelSets[:len(targets)] {
+		collector, err := newTargetCollector(targets[i], cfg, e.defaultModel)
+		if err != nil {
+			return fmt.Errorf("invalid target %q: %w", targets[i].Host, err)
+		}
+		if multiTarget {
+			labels["target"] = collector.Name()
+		}
+		if err := validateLabels(labels); err != nil {
+			return fmt.Errorf("target %s: %w", collector.Name(), err)
+		}
+		if _, ok := keys[collector.Name()]; ok {
+			return fmt.Errorf("duplicate target %q", collector.Name())
+		}
+		keys[collector.Name()] = fingerprint(targets[i], labels, profileKey)
+		if e.keys[collector.Name()] != keys[collector.Name()] {
+			added = append(added, pending{collector, labels})
+		}
+	}
+
+	var discovery *discoverer
+	discKey := ""
+	if cfg.Discovery != nil {
+		var err error
+		if discovery, err = newDiscoverer(*cfg.Discovery, cfg, e.defaultModel, labelSets[len(targets)], e.set); err != nil {
+			return fmt.Errorf("invalid discovery configuration: %w", err)
+		}
+		discKey = fingerprint(cfg.Discovery, labelSets[len(targets)], discovery.static, profileKey)
+	}
+
+	// Discovered targets are dropped along with their discovery, before the configured
+	// targets change, so names and label dimensions never clash
+	if e.disc != nil && discKey != e.discKey {
+		e.disc.stop()
+		e.disc = nil
+	}
+	removed := 0
+	for name, key := range e.keys {
+		if keys[name] != key {
+			e.set.remove(name)
+			removed++
+		}
+	}
+	unchanged := len(keys) - len(added)
+	var errs []error
+	for _, p := range added {
+		if err := e.set.add(p.collector, p.labels); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add target %s: %w", p.collector.Name(), err))
+			delete(keys, p.collector.Name())
+			continue
+		}
+		log.Printf("Polling target %s (Model: %s)", p.collector.Name(), p.collector.Profile().Model)
+	}
+	e.keys = keys
+	if discovery != nil && e.disc == nil {
+		e.disc, e.discKey = discovery, discKey
+		go discovery.run()
+	}
+	log.Printf("Configuration applied: %d targets added, %d removed, %d unchanged", len(added), removed, unchanged)
+	return errors.Join(errs...)
+}
+
+// serveReload reloads the configuration on POST /-/reload
+func (e *exporter) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.reload(); err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+		http.Error(w, fmt.Sprintf("failed to reload configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "configuration reloaded")
+}
+
+// serveHealthy reports that the exporter is running on /-/healthy
+func (e *exporter) serveHealthy(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "Datakom Exporter is Healthy.")
+}
+
+// serveReady reports that the exporter serves requests on /-/ready
+func (e *exporter) serveReady(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "Datakom Exporter is Ready.")
+}
+
+// serveQuit requests a graceful shutdown on POST /-/quit
+func (e *exporter) serveQuit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, "Requesting termination... Goodbye!")
+	e.quitOnce.Do(func() { close(e.quit) })
+}
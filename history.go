@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// historySink is a ring buffer of the readings within the retention, oldest first
+type historySink struct {
+	cfg HistoryConfig
+
+	mu       sync.RWMutex
+	readings []*datakom.Reading
+	file     *os.File
+	stale    int // Readings in the file that have left the buffer
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *HistoryConfig) validate() error {
+	if cfg.Retention < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if cfg.Retention == 0 {
+		cfg.Retention = 24 * time.Hour
+	}
+	return nil
+}
+
+// newHistorySink validates the configuration and loads the readings kept in the file
+func newHistorySink(cfg HistoryConfig) (*historySink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &historySink{cfg: cfg}
+	if cfg.File == "" {
+		return s, nil
+	}
+
+	if f, err := os.Open(cfg.File); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<24)
+		for scanner.Scan() {
+			var r datakom.Reading
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				log.Printf("Skipping invalid history record in %s: %v", cfg.File, err)
+				continue
+			}
+			s.readings = append(s.readings, &r)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", cfg.File, err)
+		}
+		// The file is in the order the readings were published, see Publish
+		slices.SortStableFunc(s.readings, func(a, b *datakom.Reading) int { return a.Time.Compare(b.Time) })
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.trim(time.Now())
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d readings of history from %s", len(s.readings), cfg.File)
+	return s, nil
+}
+
+// Publish adds the reading to the buffer and appends it to the file, dropping expired readings
+func (s *historySink) Publish(r *datakom.Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The polls of several targets finish in any order, so the buffer is kept in time order
+	// by inserting the reading after those taken before it, typically at the end
+	i := len(s.readings)
+	for i > 0 && s.readings[i-1].Time.After(r.Time) {
+		i--
+	}
+	s.readings = slices.Insert(s.readings, i, r)
+	s.trim(r.Time)
+	if s.file == nil {
+		return
+	}
+	line, _ := json.Marshal(r)
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write history to %s: %v", s.cfg.File, err)
+	}
+	// Rewrite the file once it holds more expired readings than current ones
+	if s.stale > len(s.readings) {
+		if err := s.compact(); err != nil {
+			log.Printf("Failed to compact history in %s: %v", s.cfg.File, err)
+		}
+	}
+}
+
+// trim drops the readings older than the retention, which lead the buffer kept in time order
+func (s *historySink) trim(now time.Time) {
+	cutoff := now.Add(-s.cfg.Retention)
+	n, _ := slices.BinarySearchFunc(s.readings, cutoff, func(r *datakom.Reading, t time.Time) int {
+		return r.Time.Compare(t)
+	})
+	if n > 0 {
+		s.readings = slices.Delete(s.readings, 0, n)
+		s.stale += n
+	}
+}
+
+// compact replaces the file with the readings in the buffer and reopens it for appending
+func (s *historySink) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	tmp := s.cfg.File + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range s.readings {
+		enc.Encode(r)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.cfg.File); err != nil {
+		return err
+	}
+	if s.file, err = os.OpenFile(s.cfg.File, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	s.stale = 0
+	return nil
+}
+
+// historyPoint is a value of a series at the time of its poll
+type historyPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// historySeries holds the points of one series of the requested metric
+type historySeries struct {
+	Target string            `json:"target"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Points []historyPoint    `json:"points"`
+}
+
+// serveHistory returns the points of a metric since a time, e.g.
+// /api/v1/history?metric=d500_battery_v&since=2h&target=gen-1. since is a duration before
+// now or an RFC 3339 time, and defaults to the whole retention.
+func (s *historySink) serveHistory(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+	since := time.Time{}
+	if v := q.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q, expected a duration or an RFC 3339 time", v), http.StatusBadRequest)
+			return
+		}
+	}
+	target := q.Get("target")
+
+	s.mu.RLock()
+	series := []*historySeries{}
+	index := make(map[string]*historySeries)
+	for _, r := range s.readings {
+		if r.Time.Before(since) || target != "" && r.Target != target {
+			continue
+		}
+		for _, sample := range r.Samples {
+			if sample.Name != metric {
+				continue
+			}
+			key := r.Target
+			for _, name := range slices.Sorted(maps.Keys(sample.Labels)) {
+				key += "\xff" + name + "=" + sample.Labels[name]
+			}
+			hs, ok := index[key]
+			if !ok {
+				hs = &historySeries{Target: r.Target, Labels: sample.Labels}
+				index[key] = hs
+				series = append(series, hs)
+			}
+			hs.Points = append(hs.Points, historyPoint{r.Time, sample.Value})
+		}
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-History-Retention", strconv.FormatFloat(s.cfg.Retention.Seconds(), 'f', -1, 64))
+	json.NewEncoder(w).Encode(struct {
+		Metric string           `json:"metric"`
+		Series []*historySeries `json:"series"`
+	}{metric, series})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+func TestHistoryOrder(t *testing.T) {
+	s, err := newHistorySink(HistoryConfig{Retention: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 0)
+	// Offsets in seconds of the readings, published as the polls of several targets finish
+	for _, offset := range []int{0, 10, 5, 30, 20, 95, 90} {
+		s.Publish(&datakom.Reading{Target: "gen", Time: at.Add(time.Duration(offset) * time.Second)})
+	}
+
+	var got []int
+	for _, r := range s.readings {
+		got = append(got, int(r.Time.Sub(at)/time.Second))
+	}
+	// Those over a minute before the latest reading are dropped
+	if want := []int{90, 95}; !slices.Equal(got, want) {
+		t.Errorf("readings at %v s, want %v", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// Escaping of measurement names, tag keys and tag values in InfluxDB line protocol
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// appendLineProtocol appends the reading in InfluxDB line protocol: one line per sample,
+// measured by the metric name and tagged with the target, model, constant and variable
+// labels, with the value in the "value" field
+func appendLineProtocol(b []byte, r *datakom.Reading) []byte {
+	tags := map[string]string{"target": r.Target, "model": r.Model}
+	for name, value := range r.Labels {
+		tags[name] = value
+	}
+	common := appendTags(nil, tags)
+
+	ts := strconv.FormatInt(r.Time.UnixNano(), 10)
+	for _, s := range r.Samples {
+		b = append(b, influxMeasurementEscaper.Replace(s.Name)...)
+		b = append(b, common...)
+		b = appendTags(b, s.Labels)
+		b = append(b, " value="...)
+		b = strconv.AppendFloat(b, s.Value, 'g', -1, 64)
+		b = append(b, ' ')
+		b = append(b, ts...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// appendTags appends the tags sorted by key; empty values are not allowed in line
+// protocol and are left out
+func appendTags(b []byte, tags map[string]string) []byte {
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		if tags[k] == "" {
+			continue
+		}
+		b = append(b, ',')
+		b = append(b, influxTagEscaper.Replace(k)...)
+		b = append(b, '=')
+		b = append(b, influxTagEscaper.Replace(tags[k])...)
+	}
+	return b
+}
+
+// influxSink pushes every reading in line protocol to an InfluxDB or Telegraf write
+// endpoint. Writes are made by a goroutine of their own, so an unreachable database never
+// holds up the polls of the targets.
+type influxSink struct {
+	cfg    InfluxConfig
+	client *http.Client
+	queue  chan *datakom.Reading
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *InfluxConfig) validate() error {
+	if cfg.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// newInfluxSink validates the configuration and starts writing the readings published
+func newInfluxSink(cfg InfluxConfig) (*influxSink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &influxSink{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}, queue: make(chan *datakom.Reading, outputQueueSize)}
+	go s.run()
+	return s, nil
+}
+
+// Publish queues the reading to be written, dropping it if the queue is full
+func (s *influxSink) Publish(r *datakom.Reading) {
+	select {
+	case s.queue <- r:
+	default:
+		log.Printf("InfluxDB queue full, dropping reading of %s", r.Target)
+	}
+}
+
+// run writes the queued readings
+func (s *influxSink) run() {
+	for r := range s.queue {
+		s.write(r)
+	}
+}
+
+// write sends a reading to the write endpoint
+func (s *influxSink) write(r *datakom.Reading) {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(appendLineProtocol(nil, r)))
+	if err != nil {
+		log.Printf("Failed to build InfluxDB write request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	} else if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	if err := push(s.client, req); err != nil {
+		log.Printf("Failed to write reading of %s to InfluxDB: %v", r.Target, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+func TestAppendLineProtocol(t *testing.T) {
+	at := time.Unix(1700000000, 5)
+	tests := []struct {
+		name    string
+		reading datakom.Reading
+		want    string
+	}{
+		{"sample", datakom.Reading{Target: "gen-1", Model: "d500", Time: at, Samples: []datakom.Sample{
+			{Name: "d500_battery_v", Value: 27.1},
+		}}, "d500_battery_v,model=d500,target=gen-1 value=27.1 1700000000000000005\n"},
+		{"tags sorted", datakom.Reading{Target: "gen-1", Model: "d500", Time: at, Labels: map[string]string{"site": "kyiv"}, Samples: []datakom.Sample{
+			{Name: "d500_mains_voltage_v", Labels: map[string]string{"phase": "L1"}, Value: 230},
+		}}, "d500_mains_voltage_v,model=d500,site=kyiv,target=gen-1,phase=L1 value=230 1700000000000000005\n"},
+		{"escaped", datakom.Reading{Target: "tcp://10.0.0.1:502", Model: "d500", Time: at, Labels: map[string]string{"site name": "a,b=c d"}, Samples: []datakom.Sample{
+			{Name: "d500 x,y", Labels: map[string]string{"k=": "v"}, Value: 1},
+		}}, `d500\ x\,y,model=d500,site\ name=a\,b\=c\ d,target=tcp://10.0.0.1:502,k\==v value=1 1700000000000000005` + "\n"},
+		{"empty tags left out", datakom.Reading{Target: "gen-1", Time: at, Labels: map[string]string{"site": ""}, Samples: []datakom.Sample{
+			{Name: "d500_op_status_info", Labels: map[string]string{"text": ""}, Value: 1},
+		}}, "d500_op_status_info,target=gen-1 value=1 1700000000000000005\n"},
+		{"one line per sample", datakom.Reading{Target: "gen-1", Model: "d500", Time: at, Samples: []datakom.Sample{
+			{Name: "d500_a", Value: 1}, {Name: "d500_b", Value: 1.5e-7},
+		}}, "d500_a,model=d500,target=gen-1 value=1 1700000000000000005\nd500_b,model=d500,target=gen-1 value=1.5e-07 1700000000000000005\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(appendLineProtocol(nil, &tt.reading)); got != tt.want {
+				t.Errorf("appendLineProtocol() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,155 +1,269 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/simonvetter/modbus"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/common/version"
 )
 
-// DatakomCollector holds the modbus client and metric descriptors
-type DatakomCollector struct {
-	client *modbus.ModbusClient
-	target string
-
-	// Metric descriptors
-	mainsV       *prometheus.Desc
-	mainsI       *prometheus.Desc
-	genPower     *prometheus.Desc
-	genEnergy    *prometheus.Desc
-	genFreq      *prometheus.Desc
-	batteryV     *prometheus.Desc
-	fuelLevel    *prometheus.Desc
-	coolantTemp  *prometheus.Desc
-	opStatus     *prometheus.Desc
-	runHours     *prometheus.Desc
-	serviceHours *prometheus.Desc
-	serviceDays  *prometheus.Desc
-}
+// Poll interval used when outputs need background polling but none is configured
+const defaultPollInterval = 30 * time.Second
 
-// NewDatakomCollector initializes the collector with predefined metric descriptors
-func NewDatakomCollector(client *modbus.ModbusClient, target string) *DatakomCollector {
-	return &DatakomCollector{
-		client: client,
-		target: target,
-		mainsV: prometheus.NewDesc("d500_mains_voltage_v", "Mains phase voltage", []string{"phase"}, nil),
-		mainsI: prometheus.NewDesc("d500_mains_current_a", "Mains phase current", []string{"phase"}, nil),
-		genPower: prometheus.NewDesc("d500_genset_power_kw", "Total Active Power", nil, nil),
-		genEnergy: prometheus.NewDesc("d500_total_energy_kwh", "Total Accumulated Energy", nil, nil),
-		genFreq: prometheus.NewDesc("d500_gen_freq_hz", "Genset Frequency", nil, nil),
-		batteryV: prometheus.NewDesc("d500_battery_v", "Battery Voltage", nil, nil),
-		fuelLevel: prometheus.NewDesc("d500_fuel_percent", "Fuel Level", nil, nil),
-		coolantTemp: prometheus.NewDesc("d500_engine_temp_c", "Coolant Temperature", nil, nil),
-		opStatus: prometheus.NewDesc("d500_op_status", "Operational Status", nil, nil),
-		runHours: prometheus.NewDesc("d500_run_hours_total", "Total Engine Run Hours", nil, nil),
-		serviceHours: prometheus.NewDesc("d500_service_hours_remain", "Hours remaining to Maintenance", nil, nil),
-		serviceDays: prometheus.NewDesc("d500_service_days_remain", "Days remaining to Maintenance", nil, nil),
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
 	}
+	return fallback
 }
 
-// Describe sends the descriptors of each metric over to Prometheus
-func (c *DatakomCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.mainsV
-	ch <- c.mainsI
-	ch <- c.genPower
-	ch <- c.genEnergy
-	ch <- c.genFreq
-	ch <- c.batteryV
-	ch <- c.fuelLevel
-	ch <- c.coolantTemp
-	ch <- c.opStatus
-	ch <- c.runHours
-	ch <- c.serviceHours
-	ch <- c.serviceDays
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Ignoring invalid duration %s=%q", key, value)
+	}
+	return fallback
 }
 
-// Collect triggers the Modbus polling logic during every scrape request
-func (c *DatakomCollector) Collect(ch chan<- prometheus.Metric) {
-	log.Printf("Starting scrape for target %s", c.target)
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		log.Printf("Ignoring invalid boolean %s=%q", key, value)
+	}
+	return fallback
+}
 
-	// Open connection to the controller
-	if err := c.client.Open(); err != nil {
-		log.Printf("Failed to connect to %s: %v", c.target, err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulator" {
+		runSimulator(os.Args[2:])
 		return
 	}
-	defer c.client.Close()
-
-	// Block 1: Mains Voltages (Addr: 10240)
-	if r, err := c.client.ReadRegisters(10240, 6, modbus.HOLDING_REGISTER); err == nil {
-		ch <- prometheus.MustNewConstMetric(c.mainsV, prometheus.GaugeValue, float64(getUint32(r, 0))/10.0, "L1")
-		ch <- prometheus.MustNewConstMetric(c.mainsV, prometheus.GaugeValue, float64(getUint32(r, 2))/10.0, "L2")
-		ch <- prometheus.MustNewConstMetric(c.mainsV, prometheus.GaugeValue, float64(getUint32(r, 4))/10.0, "L3")
+	if len(os.Args) > 1 && os.Args[1] == "dashboard" {
+		runDashboard(os.Args[2:])
+		return
 	}
-
-	// Block 2: Mains Currents (Addr: 10264)
-	if r, err := c.client.ReadRegisters(10264, 6, modbus.HOLDING_REGISTER); err == nil {
-		ch <- prometheus.MustNewConstMetric(c.mainsI, prometheus.GaugeValue, float64(getUint32(r, 0))/10.0, "I1")
-		ch <- prometheus.MustNewConstMetric(c.mainsI, prometheus.GaugeValue, float64(getUint32(r, 2))/10.0, "I2")
-		ch <- prometheus.MustNewConstMetric(c.mainsI, prometheus.GaugeValue, float64(getUint32(r, 4))/10.0, "I3")
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		runCheckConfig(os.Args[2:])
+		return
 	}
 
-	// Block 3: Engine Parameters and Frequency (Addr: 10294-10363)
-	if r, err := c.client.ReadRegisters(10294, 2, modbus.HOLDING_REGISTER); err == nil {
-		ch <- prometheus.MustNewConstMetric(c.genPower, prometheus.GaugeValue, float64(getUint32(r, 0))/10.0)
+	model := flag.String("device.model", getEnv("DATAKOM_MODEL", "d500"), "Controller model (d300, d500, d700, dkg507, dkg509)")
+	configFile := flag.String("config.file", getEnv("DATAKOM_CONFIG", ""), "Path to the optional YAML configuration file")
+	telemetryAddress := flag.String("web.telemetry-address", getEnv("EXPORTER_TELEMETRY_ADDRESS", ""), "Serve the exporter's own metrics and the Modbus link metrics on this address, e.g. 127.0.0.1:9101, apart from the device metrics")
+	enablePprof := flag.Bool("web.enable-pprof", getEnvBool("EXPORTER_PPROF", false), "Expose Go profiling endpoints under /debug/pprof")
+	enableRegisters := flag.Bool("web.enable-debug-registers", getEnvBool("EXPORTER_DEBUG_REGISTERS", false), "Serve ad-hoc register reads from the controllers on /debug/registers")
+	enableLifecycle := flag.Bool("web.enable-lifecycle", getEnvBool("EXPORTER_LIFECYCLE", false), "Enable shutdown and configuration reloads via HTTP requests on /-/quit and /-/reload")
+	controlTokenFile := flag.String("web.control-token-file", getEnv("EXPORTER_CONTROL_TOKEN_FILE", ""), "File holding the bearer token that enables control commands on /api/v1/control")
+	auditFile := flag.String("web.control-audit-log", getEnv("EXPORTER_AUDIT_LOG", ""), "File recording every control write as a JSON line, in addition to the log")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	pollInterval := flag.Duration("poll.interval", getEnvDuration("POLL_INTERVAL", 0), "Poll controllers in the background at this interval and serve scrapes from the latest reading (0 = poll on scrape)")
+	maxAge := flag.Duration("poll.max-age", getEnvDuration("POLL_MAX_AGE", 0), "Stop serving background readings older than this (0 = three poll intervals)")
+	once := flag.Bool("once", getEnvBool("EXPORTER_ONCE", false), "Poll the targets once, write their metrics in the text format and exit")
+	onceOutput := flag.String("once.output", getEnv("EXPORTER_ONCE_OUTPUT", "-"), "File the metrics of --once are written to, e.g. for the node_exporter textfile collector (- = stdout)")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.Print("datakom_exporter"))
+		return
 	}
-	if r, err := c.client.ReadRegisters(10339, 25, modbus.HOLDING_REGISTER); err == nil && len(r) >= 25 {
-		ch <- prometheus.MustNewConstMetric(c.genFreq, prometheus.GaugeValue, float64(r[0])/100.0)
-		ch <- prometheus.MustNewConstMetric(c.batteryV, prometheus.GaugeValue, float64(r[2])/100.0)
-		ch <- prometheus.MustNewConstMetric(c.coolantTemp, prometheus.GaugeValue, float64(r[23])/10.0)
-		ch <- prometheus.MustNewConstMetric(c.fuelLevel, prometheus.GaugeValue, float64(r[24])/10.0)
+	if *once {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if err := runOnce(cfg, *configFile, *model, *onceOutput); err != nil {
+			log.Fatalf("Failed to write metrics: %v", err)
+		}
+		return
 	}
+	log.Printf("Starting datakom_exporter %s", version.Info())
+	prometheus.MustRegister(versioncollector.NewCollector("datakom_exporter"))
 
-	// Block 4: Operation Status and Service Counters (Addr: 10604-10636)
-	if r, err := c.client.ReadRegisters(10604, 34, modbus.HOLDING_REGISTER); err == nil && len(r) >= 34 {
-		ch <- prometheus.MustNewConstMetric(c.opStatus, prometheus.GaugeValue, float64(r[0]))
-		ch <- prometheus.MustNewConstMetric(c.runHours, prometheus.GaugeValue, float64(getUint32(r, 18))/100.0)
-		ch <- prometheus.MustNewConstMetric(c.genEnergy, prometheus.GaugeValue, float64(getUint32(r, 24))/10.0)
-		ch <- prometheus.MustNewConstMetric(c.serviceHours, prometheus.GaugeValue, float64(getUint32(r, 30))/100.0)
-		ch <- prometheus.MustNewConstMetric(c.serviceDays, prometheus.GaugeValue, float64(getUint32(r, 32))/100.0)
+	controlToken, err := loadControlToken(*controlTokenFile)
+	if err != nil {
+		log.Fatalf("Failed to load control token: %v", err)
 	}
-}
 
-// getUint32 handles word swapping for 32-bit values: Low Word First (Little-Endian Word Order)
-func getUint32(regs []uint16, offset int) uint32 {
-	if len(regs) < offset+2 {
-		return 0
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	// Datakom D500 uses Low Word first
-	return uint32(regs[offset+1])<<16 | uint32(regs[offset])
-}
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	set := newTargetSet()
+	if cfg.MQTT != nil {
+		sink, err := newMQTTSink(*cfg.MQTT)
+		if err != nil {
+			log.Fatalf("Invalid MQTT configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, sink)
+	}
+	if cfg.Influx != nil {
+		sink, err := newInfluxSink(*cfg.Influx)
+		if err != nil {
+			log.Fatalf("Invalid InfluxDB configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, sink)
+	}
+	if cfg.OTLP != nil {
+		sink, err := newOTLPSink(*cfg.OTLP)
+		if err != nil {
+			log.Fatalf("Invalid OTLP configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, sink)
+	}
+	if cfg.RemoteWrite != nil {
+		sink, err := newRemoteWriteSink(*cfg.RemoteWrite)
+		if err != nil {
+			log.Fatalf("Invalid remote write configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, sink)
+	}
+	var history *historySink
+	if cfg.History != nil {
+		if history, err = newHistorySink(*cfg.History); err != nil {
+			log.Fatalf("Invalid history configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, history)
+	}
+	if cfg.Notify != nil {
+		sink, err := newNotifySink(*cfg.Notify)
+		if err != nil {
+			log.Fatalf("Invalid notification configuration: %v", err)
+		}
+		set.sinks = append(set.sinks, sink)
+	}
+	set.pollInterval = *pollInterval
+	if len(set.sinks) > 0 && set.pollInterval == 0 {
+		// Outputs other than scrapes need readings independent of Prometheus
+		set.pollInterval = defaultPollInterval
+		log.Printf("Outputs enabled, polling every %s", set.pollInterval)
+	}
+	watchdog, err := sdWatchdog()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if watchdog > 0 && set.pollInterval == 0 {
+		// The systemd watchdog is pinged as long as background polls complete
+		set.pollInterval = defaultPollInterval
+		log.Printf("systemd watchdog enabled, polling every %s", set.pollInterval)
+	}
+	set.separateTelemetry = *telemetryAddress != ""
+	set.maxAge = *maxAge
+	if set.maxAge == 0 {
+		set.maxAge = 3 * set.pollInterval
 	}
-	return fallback
-}
-
-func main() {
-	// Connection settings derived from environment variables
-	host := getEnv("DATAKOM_HOST", "192.168.100.100")
-	port := getEnv("DATAKOM_PORT", "502")
-	address := fmt.Sprintf("tcp://%s:%s", host, port)
 
-	// Initialize Modbus TCP client
-	client, _ := modbus.NewClient(&modbus.ClientConfiguration{
-		URL: address, Timeout: 5 * time.Second,
-	})
-	client.SetUnitId(1) // Standard Modbus Address for Datakom devices
+	e := newExporter(*configFile, *model, set)
+	if err := e.apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if watchdog > 0 {
+		log.Printf("Pinging the systemd watchdog every %s while polling keeps up", watchdog/2)
+		go runWatchdog(set, watchdog)
+	}
 
-	// Register the custom real-time collector
-	collector := NewDatakomCollector(client, address)
-	prometheus.MustRegister(collector)
+	// SIGHUP reloads the configuration, like POST /-/reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Reloading configuration")
+			if err := e.reload(); err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
 
 	// Start the HTTP server for Prometheus scraping
 	exporterPort := getEnv("EXPORTER_PORT", "8000")
-	log.Printf("Prometheus Exporter started on :%s/metrics (Target: %s)", exporterPort, address)
-	
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":"+exporterPort, nil))
-}
\ No newline at end of file
+	log.Printf("Prometheus Exporter started on :%s/metrics (%d targets)", exporterPort, set.len())
+
+	// A dedicated mux keeps the pprof handlers, which net/http/pprof registers
+	// on the default mux, unreachable unless enabled
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", set.serveMetrics)
+	mux.HandleFunc("/sd", set.serveSD)
+	mux.HandleFunc("/-/healthy", e.serveHealthy)
+	mux.HandleFunc("/-/ready", e.serveReady)
+	if *enableLifecycle {
+		mux.HandleFunc("/-/reload", e.serveReload)
+		mux.HandleFunc("/-/quit", e.serveQuit)
+	}
+	mux.HandleFunc("/api/v1/readings", set.serveReadings)
+	if history != nil {
+		mux.HandleFunc("/api/v1/history", history.serveHistory)
+	}
+	mux.HandleFunc("/influx", set.serveInflux)
+	mux.HandleFunc("/events", set.handler(serveEvents))
+	if *enableRegisters {
+		mux.HandleFunc("/debug/registers", set.handler(serveRegisters))
+	}
+	if controlToken != "" {
+		audit, err := newAuditLog(*auditFile)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		ctl := &controlAPI{audit: audit}
+		mux.HandleFunc("/api/v1/control", authorize(controlToken, set.handler(ctl.serveControl)))
+		mux.HandleFunc("/api/v1/alarms", authorize(controlToken, set.handler(ctl.serveAlarms)))
+		log.Printf("Control commands enabled on :%s/api/v1/control and /api/v1/alarms", exporterPort)
+	}
+
+	// Internal observability is served on the telemetry listener if one is set
+	telemetryMux, telemetryAddr := mux, ":"+exporterPort
+	if set.separateTelemetry {
+		telemetryMux, telemetryAddr = http.NewServeMux(), *telemetryAddress
+		telemetryMux.Handle("/metrics", set.telemetryHandler)
+	}
+	if *enablePprof {
+		telemetryMux.HandleFunc("/debug/pprof/", pprof.Index)
+		telemetryMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		telemetryMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		telemetryMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		telemetryMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		log.Printf("Profiling endpoints enabled on %s/debug/pprof/", telemetryAddr)
+	}
+	if set.separateTelemetry {
+		log.Printf("Telemetry served on %s/metrics", telemetryAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(telemetryAddr, telemetryMux))
+		}()
+	}
+
+	server := &http.Server{Addr: ":" + exporterPort, Handler: mux}
+	go func() {
+		<-e.quit
+		log.Printf("Shutting down on request")
+		sdNotify("STOPPING=1")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Type=notify units are started once the exporter accepts scrapes
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
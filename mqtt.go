@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// Time allowed for the broker to acknowledge the messages of a reading
+const mqttPublishTimeout = 5 * time.Second
+
+// mqttSink publishes readings to an MQTT broker, either as one JSON document per
+// poll on <topic>/<target> or as one payload per series on
+// <topic>/<target>/<metric>[/<label values>...]. Messages are published by a goroutine
+// of their own, so a slow broker never holds up the polls of the targets.
+type mqttSink struct {
+	cfg    MQTTConfig
+	client mqtt.Client
+	queue  chan *datakom.Reading
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *MQTTConfig) validate() error {
+	if cfg.Broker == "" {
+		return fmt.Errorf("broker is required")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "datakom-exporter"
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "datakom"
+	}
+	cfg.Topic = strings.TrimSuffix(cfg.Topic, "/")
+	if cfg.Mode == "" {
+		cfg.Mode = "reading"
+	}
+	if cfg.Mode != "reading" && cfg.Mode != "metric" {
+		return fmt.Errorf("mode must be reading or metric, got %q", cfg.Mode)
+	}
+	if cfg.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2, got %d", cfg.QoS)
+	}
+	return nil
+}
+
+// newMQTTSink validates the configuration and starts connecting to the broker in the background
+func newMQTTSink(cfg MQTTConfig) (*mqttSink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(mqtt.Client) { log.Printf("Connected to MQTT broker %s", cfg.Broker) }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Printf("Lost connection to MQTT broker %s: %v", cfg.Broker, err) })
+	s := &mqttSink{cfg: cfg, client: mqtt.NewClient(opts), queue: make(chan *datakom.Reading, outputQueueSize)}
+	s.client.Connect()
+	go s.run()
+	return s, nil
+}
+
+// Publish queues the reading to be sent; readings are dropped while the broker is
+// unreachable or the queue is full
+func (s *mqttSink) Publish(r *datakom.Reading) {
+	if !s.client.IsConnectionOpen() {
+		log.Printf("MQTT broker %s not connected, dropping reading of %s", s.cfg.Broker, r.Target)
+		return
+	}
+	select {
+	case s.queue <- r:
+	default:
+		log.Printf("MQTT queue full, dropping reading of %s", r.Target)
+	}
+}
+
+// run publishes the queued readings
+func (s *mqttSink) run() {
+	for r := range s.queue {
+		s.publish(r)
+	}
+}
+
+// mqttMessage is a payload to publish on a topic
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// publish sends the messages of the reading, waiting for the broker to acknowledge them
+func (s *mqttSink) publish(r *datakom.Reading) {
+	msgs := s.messages(r)
+	tokens := make([]mqtt.Token, len(msgs))
+	for i, m := range msgs {
+		tokens[i] = s.client.Publish(m.topic, s.cfg.QoS, s.cfg.Retain, m.payload)
+	}
+	deadline := time.Now().Add(mqttPublishTimeout)
+	var errs []error
+	for i, t := range tokens {
+		if !t.WaitTimeout(time.Until(deadline)) {
+			errs = append(errs, fmt.Errorf("timed out publishing to %s", msgs[i].topic))
+		} else if err := t.Error(); err != nil {
+			errs = append(errs, fmt.Errorf("publishing to %s: %w", msgs[i].topic, err))
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("Failed to publish %d of %d MQTT messages of %s, first: %v", len(errs), len(msgs), r.Target, errs[0])
+	}
+}
+
+// messages encodes the reading in the configured mode
+func (s *mqttSink) messages(r *datakom.Reading) []mqttMessage {
+	base := s.cfg.Topic + "/" + topicSegment(r.Target)
+	if s.cfg.Mode == "reading" {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("Failed to encode reading of %s: %v", r.Target, err)
+			return nil
+		}
+		return []mqttMessage{{base, payload}}
+	}
+
+	var msgs []mqttMessage
+	for _, sample := range r.Samples {
+		topic := base + "/" + sample.Name
+		for _, v := range sample.LabelValues() {
+			topic += "/" + topicSegment(v)
+		}
+		payload, err := json.Marshal(struct {
+			Value  float64           `json:"value"`
+			Labels map[string]string `json:"labels,omitempty"`
+			Time   time.Time         `json:"time"`
+		}{sample.Value, sample.Labels, r.Time})
+		if err != nil {
+			log.Printf("Failed to encode %s of %s: %v", sample.Name, r.Target, err)
+			continue
+		}
+		msgs = append(msgs, mqttMessage{topic, payload})
+	}
+	return msgs
+}
+
+// topicSegment makes a value usable as a single MQTT topic level
+func topicSegment(v string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_").Replace(v)
+}
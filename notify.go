@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// Formats of the notification webhook
+const (
+	notifyJSON     = "json"
+	notifySlack    = "slack"
+	notifyTelegram = "telegram"
+)
+
+// NotifyConfig enables notifying a webhook of alarm state changes, evaluated on each poll,
+// for sites without Alertmanager
+type NotifyConfig struct {
+	URL     string            `yaml:"url"`     // e.g. a Slack incoming webhook or https://api.telegram.org/bot<token>/sendMessage
+	Format  string            `yaml:"format"`  // json (default), slack or telegram
+	ChatID  string            `yaml:"chat_id"` // Telegram chat receiving the messages
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"` // Defaults to 10s
+
+	Alarms        []AlarmConfig `yaml:"alarms"`         // Further metrics notified when they become non-zero and zero again
+	ShutdownCodes []int         `yaml:"shutdown_codes"` // op_status codes of shutdowns, as the code tables differ by firmware
+}
+
+// AlarmConfig is a metric, without the model prefix, whose series are alarms while non-zero,
+// e.g. a digital input wired to a fault contact. All alarm bits of the register map are
+// notified unless alarm_active is listed, which restricts them to the series listed.
+type AlarmConfig struct {
+	Metric string            `yaml:"metric"`
+	Labels map[string]string `yaml:"labels"` // Restricts the alarm to the series with these labels
+	Name   string            `yaml:"name"`   // Shown in the notifications, defaults to the metric
+}
+
+// notification is a change of an alarm or shutdown state of a target
+type notification struct {
+	Target string            `json:"target"`
+	Model  string            `json:"model"`
+	Labels map[string]string `json:"labels,omitempty"` // Constant labels of the target
+	Alarm  string            `json:"alarm"`
+	Active bool              `json:"active"`
+	Value  float64           `json:"value"`
+	Time   time.Time         `json:"time"`
+}
+
+// text describes the notification in a chat message
+func (n notification) text() string {
+	state := "cleared"
+	if n.Active {
+		state = "ACTIVE"
+	}
+	return fmt.Sprintf("%s on %s: %s (%s)", n.Alarm, n.Target, state, n.Time.Format(time.RFC3339))
+}
+
+// Notifications queued for the webhook, beyond which further changes are dropped
+const notifyQueueSize = 100
+
+// notifySink tracks the alarm states of every target and calls the webhook on changes.
+// Notifications are sent in order by a goroutine of their own, so a slow webhook never
+// holds up the polls of the targets.
+type notifySink struct {
+	cfg    NotifyConfig
+	client *http.Client
+	queue  chan notification
+
+	restricted bool // Whether only the listed alarm bits are notified
+
+	mu     sync.Mutex
+	states map[string]bool // Active alarms by target and alarm
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *NotifyConfig) validate() error {
+	if cfg.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = notifyJSON
+	case notifyJSON, notifySlack:
+	case notifyTelegram:
+		if cfg.ChatID == "" {
+			return fmt.Errorf("chat_id is required with the telegram format")
+		}
+	default:
+		return fmt.Errorf("unknown format %q, expected json, slack or telegram", cfg.Format)
+	}
+	for i, a := range cfg.Alarms {
+		if a.Metric == "" {
+			return fmt.Errorf("alarm %d: metric is required", i+1)
+		}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// newNotifySink validates the configuration and starts sending the notifications of the
+// readings published
+func newNotifySink(cfg NotifyConfig) (*notifySink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &notifySink{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		queue:      make(chan notification, notifyQueueSize),
+		states:     make(map[string]bool),
+		restricted: slices.ContainsFunc(cfg.Alarms, func(a AlarmConfig) bool { return a.Metric == datakom.AlarmMetric }),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Publish evaluates the alarms on the reading and notifies of those that changed. Alarms
+// are assumed inactive before the first reading, so alarms present at startup are notified.
+// Failed readings leave the states unchanged.
+func (s *notifySink) Publish(r *datakom.Reading) {
+	if r.Error != "" {
+		return
+	}
+	var changes []notification
+	s.mu.Lock()
+	for _, n := range s.evaluate(r) {
+		key := r.Target + "\xff" + n.Alarm
+		if s.states[key] != n.Active {
+			s.states[key] = n.Active
+			changes = append(changes, n)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, n := range changes {
+		log.Printf("%s", n.text())
+		select {
+		case s.queue <- n:
+		default:
+			log.Printf("Notification queue full, dropping %s on %s", n.Alarm, n.Target)
+		}
+	}
+}
+
+// run sends the queued notifications
+func (s *notifySink) run() {
+	for n := range s.queue {
+		if err := s.send(n); err != nil {
+			log.Printf("Failed to notify of %s on %s: %v", n.Alarm, n.Target, err)
+		}
+	}
+}
+
+// evaluate returns the current state of every alarm of the reading
+func (s *notifySink) evaluate(r *datakom.Reading) []notification {
+	var states []notification
+	prefix := r.Model + "_"
+	for _, sample := range r.Samples {
+		metric, ok := strings.CutPrefix(sample.Name, prefix)
+		if !ok {
+			continue
+		}
+		if metric == "op_status" && len(s.cfg.ShutdownCodes) > 0 {
+			active := slices.Contains(s.cfg.ShutdownCodes, int(sample.Value))
+			states = append(states, notification{Alarm: "Shutdown", Active: active, Value: sample.Value})
+			continue
+		}
+		if metric == datakom.AlarmMetric && !s.restricted {
+			states = append(states, notification{Alarm: alarmName(metric, sample.Labels), Active: sample.Value != 0, Value: sample.Value})
+			continue
+		}
+		for _, a := range s.cfg.Alarms {
+			if a.Metric != metric || !matchLabels(sample.Labels, a.Labels) {
+				continue
+			}
+			name := a.Name
+			if name == "" {
+				name = alarmName(metric, sample.Labels)
+			}
+			states = append(states, notification{Alarm: name, Active: sample.Value != 0, Value: sample.Value})
+		}
+	}
+	for i := range states {
+		states[i].Target, states[i].Model, states[i].Labels, states[i].Time = r.Target, r.Model, r.Labels, r.Time
+	}
+	return states
+}
+
+// matchLabels reports whether the labels include all of the wanted ones
+func matchLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// alarmName names the alarm of a series: an alarm bit by its alarm and severity, e.g.
+// low_oil_pressure shutdown, and other series as seriesName does
+func alarmName(metric string, labels map[string]string) string {
+	if metric == datakom.AlarmMetric {
+		return labels["alarm"] + " " + labels["severity"]
+	}
+	return seriesName(metric, labels)
+}
+
+// seriesName names a series in PromQL notation, e.g. digital_input{input="3"}
+func seriesName(metric string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return metric
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return metric + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// send calls the webhook with the notification in the configured format
+func (s *notifySink) send(n notification) error {
+	var body any = n
+	switch s.cfg.Format {
+	case notifySlack:
+		body = map[string]string{"text": n.text()}
+	case notifyTelegram:
+		body = map[string]string{"chat_id": s.cfg.ChatID, "text": n.text()}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	return push(s.client, req)
+}
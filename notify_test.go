@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+func TestNotifyEvaluate(t *testing.T) {
+	reading := &datakom.Reading{Target: "gen-1", Model: "d500", Samples: []datakom.Sample{
+		{Name: "d500_op_status", Value: 30},
+		{Name: "d500_alarm_active", Labels: map[string]string{"severity": "shutdown", "alarm": "low_oil_pressure"}, Value: 1},
+		{Name: "d500_alarm_active", Labels: map[string]string{"severity": "warning", "alarm": "low_fuel_level"}, Value: 0},
+		{Name: "d500_digital_input", Labels: map[string]string{"input": "3"}, Value: 1},
+	}}
+	tests := []struct {
+		name string
+		cfg  NotifyConfig
+		want []string // alarm=active
+	}{
+		{"alarm bits by default", NotifyConfig{}, []string{
+			"low_oil_pressure shutdown=true", "low_fuel_level warning=false",
+		}},
+		{"shutdown codes", NotifyConfig{ShutdownCodes: []int{30}}, []string{
+			"Shutdown=true", "low_oil_pressure shutdown=true", "low_fuel_level warning=false",
+		}},
+		{"further metrics", NotifyConfig{Alarms: []AlarmConfig{{Metric: "digital_input", Labels: map[string]string{"input": "3"}, Name: "Low fuel switch"}}}, []string{
+			"low_oil_pressure shutdown=true", "low_fuel_level warning=false", "Low fuel switch=true",
+		}},
+		{"alarm bits restricted", NotifyConfig{Alarms: []AlarmConfig{{Metric: "alarm_active", Labels: map[string]string{"severity": "shutdown"}}}}, []string{
+			"low_oil_pressure shutdown=true",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.URL = "http://127.0.0.1:0/"
+			s, err := newNotifySink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range s.evaluate(reading) {
+				got = append(got, fmt.Sprintf("%s=%t", n.Alarm, n.Active))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
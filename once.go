@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnce polls the configured targets a single time and writes their metrics in the text
+// exposition format to the output, "-" for stdout. Files are replaced atomically, so the
+// node_exporter textfile collector never reads a partial file. Only the device metrics are
+// written, as the exporter's own would clash with those of the node_exporter.
+func runOnce(cfg *Config, configFile, model, output string) error {
+	if cfg.Discovery != nil {
+		log.Printf("Ignoring discovery in one-shot mode, polling the configured targets only")
+		cfg.Discovery = nil
+	}
+	set := newTargetSet()
+	if err := newExporter(configFile, model, set).apply(cfg); err != nil {
+		return err
+	}
+
+	set.mu.RLock()
+	var g prometheus.Gatherers
+	for _, name := range set.names {
+		g = append(g, set.targets[name].registry)
+	}
+	set.mu.RUnlock()
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return err
+		}
+	}
+	if output == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		return fmt.Errorf("replacing %s: %w", output, err)
+	}
+	return nil
+}
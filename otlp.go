@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+)
+
+// OTLP aggregation temporality of the controller's lifetime counters
+const otlpCumulative = 2
+
+// The OTLP/HTTP JSON encoding of an export request, limited to the fields used here
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Unit        string     `json:"unit,omitempty"`
+		Gauge       *otlpGauge `json:"gauge,omitempty"`
+		Sum         *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+)
+
+// otlpAttributes converts labels into attributes sorted by key, leaving out empty values
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		if labels[k] == "" {
+			continue
+		}
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = labels[k]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// otlpSink pushes every reading to an OpenTelemetry collector over OTLP/HTTP, using the JSON
+// encoding. Exports are made by a goroutine of their own, so an unreachable collector never
+// holds up the polls of the targets.
+type otlpSink struct {
+	cfg    OTLPConfig
+	client *http.Client
+	start  string // Start time of the cumulative sums
+	queue  chan *datakom.Reading
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *OTLPConfig) validate() error {
+	if cfg.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// newOTLPSink validates the configuration and starts exporting the readings published
+func newOTLPSink(cfg OTLPConfig) (*otlpSink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &otlpSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		start:  strconv.FormatInt(time.Now().UnixNano(), 10),
+		queue:  make(chan *datakom.Reading, outputQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// resource returns the resource of a reading: the configured attributes, overridden
+// by the target's constant labels (e.g. site), its name and model
+func (s *otlpSink) resource(r *datakom.Reading) otlpResource {
+	attrs := map[string]string{"service.name": "datakom-exporter"}
+	for k, v := range s.cfg.ResourceAttributes {
+		attrs[k] = v
+	}
+	for k, v := range r.Labels {
+		attrs[k] = v
+	}
+	attrs["target"] = r.Target
+	attrs["model"] = r.Model
+	return otlpResource{Attributes: otlpAttributes(attrs)}
+}
+
+// request encodes the reading, with one metric per name holding the data point of every series
+func (s *otlpSink) request(r *datakom.Reading) otlpRequest {
+	ts := strconv.FormatInt(r.Time.UnixNano(), 10)
+	var metrics []otlpMetric
+	index := make(map[string]int)
+	for _, sample := range r.Samples {
+		i, ok := index[sample.Name]
+		if !ok {
+			m := otlpMetric{Name: sample.Name, Description: sample.Help(), Unit: otlpUnit(sample.Unit)}
+			if sample.Counter() {
+				m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			} else {
+				m.Gauge = &otlpGauge{}
+			}
+			i = len(metrics)
+			index[sample.Name] = i
+			metrics = append(metrics, m)
+		}
+
+		p := otlpDataPoint{Attributes: otlpAttributes(sample.Labels), TimeUnixNano: ts, AsDouble: sample.Value}
+		if m := &metrics[i]; m.Sum != nil {
+			p.StartTimeUnixNano = s.start
+			m.Sum.DataPoints = append(m.Sum.DataPoints, p)
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, p)
+		}
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     s.resource(r),
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "datakom-exporter"}, Metrics: metrics}},
+	}}}
+}
+
+// otlpUnit converts a unit into its UCUM code, as OpenTelemetry expects
+func otlpUnit(unit string) string {
+	switch unit {
+	case "°C":
+		return "Cel"
+	case "°F":
+		return "[degF]"
+	case "°":
+		return "deg"
+	}
+	return unit
+}
+
+// Publish queues the reading to be exported, dropping it if the queue is full
+func (s *otlpSink) Publish(r *datakom.Reading) {
+	select {
+	case s.queue <- r:
+	default:
+		log.Printf("OTLP queue full, dropping reading of %s", r.Target)
+	}
+}
+
+// run exports the queued readings
+func (s *otlpSink) run() {
+	for r := range s.queue {
+		s.export(r)
+	}
+}
+
+// export sends a reading to the collector
+func (s *otlpSink) export(r *datakom.Reading) {
+	body, err := json.Marshal(s.request(r))
+	if err != nil {
+		log.Printf("Failed to encode reading of %s: %v", r.Target, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to build OTLP export request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if err := push(s.client, req); err != nil {
+		log.Printf("Failed to export reading of %s over OTLP: %v", r.Target, err)
+	}
+}
@@ -0,0 +1,88 @@
+package datakom
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Metrics exported by the collector besides the registers, without the model prefix
+var derivedMetrics = []string{
+	"block_read_success", "service_due", "load_percent", "watchdog_triggers_total",
+	"modbus_read_duration_seconds", "modbus_read_errors_total",
+	"fuel_rate_percent_per_hour", "fuel_rate_liters_per_hour", "fuel_runtime_remaining_hours",
+	"fuel_rate_percent_per_second", "fuel_rate_liters_per_second", "fuel_runtime_remaining_seconds",
+	"location_info",
+}
+
+// Check validates the register map of the profile: blocks within the Modbus limits and not
+// overlapping, registers within their blocks, and metric names that neither collide with
+// each other nor with the derived metrics. All problems found are returned.
+func (p *DeviceProfile) Check() []error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	blocks := make([]*Block, len(p.Blocks))
+	names := make(map[string]bool)
+	for i := range p.Blocks {
+		b := &p.Blocks[i]
+		blocks[i] = b
+		if names[b.Name] {
+			fail("block %s: defined more than once", b.Name)
+		}
+		names[b.Name] = true
+		switch {
+		case b.Count == 0:
+			fail("block %s: no registers to read", b.Name)
+		case b.Count > maxReadSize:
+			fail("block %s: %d registers exceed the Modbus limit of %d per read", b.Name, b.Count, maxReadSize)
+		case int(b.Address)+int(b.Count) > 1<<16:
+			fail("block %s: registers %d-%d exceed the Modbus address space", b.Name, b.Address, int(b.Address)+int(b.Count)-1)
+		}
+		for _, r := range b.Registers {
+			if r.Offset < 0 || r.Offset+r.size() > int(b.Count) {
+				fail("register %s: %s value at offset %d exceeds block %s of %d registers", r.Name, r.Type, r.Offset, b.Name, b.Count)
+			}
+		}
+	}
+
+	slices.SortStableFunc(blocks, func(a, b *Block) int { return int(a.Address) - int(b.Address) })
+	end := func(b *Block) int { return int(b.Address) + int(b.Count) }
+	for i := 1; i < len(blocks); i++ {
+		// Compared with the earlier block reaching furthest, which a later block overlaps first
+		prev, b := slices.MaxFunc(blocks[:i], func(a, b *Block) int { return end(a) - end(b) }), blocks[i]
+		if int(b.Address) < end(prev) {
+			fail("blocks %s (%d-%d) and %s (%d-%d) overlap", prev.Name, prev.Address, end(prev)-1, b.Name, b.Address, end(b)-1)
+		}
+	}
+
+	// Registers sharing a name must have the same label names and distinct label values
+	labels := make(map[string]string)
+	series := make(map[string]string)
+	metric := func(name, labelNames, block string) {
+		if slices.Contains(derivedMetrics, name) {
+			fail("register %s in block %s: collides with the derived metric %s_%s", name, block, p.Prefix, name)
+		}
+		if l, ok := labels[name]; ok && l != labelNames {
+			fail("register %s in block %s: label names [%s] differ from [%s] of the other %s registers", name, block, labelNames, l, name)
+		}
+		labels[name] = labelNames
+	}
+	for _, b := range p.Blocks {
+		for _, r := range b.Registers {
+			labelNames := strings.Join(r.labelNames(), ",")
+			metric(r.Name, labelNames, b.Name)
+			if r.Codes != nil {
+				metric(r.Name+"_info", strings.Join(append(r.labelNames(), "code", "text"), ","), b.Name)
+			}
+			key := r.Name + "{" + strings.Join(r.labelValues(), ",") + "}"
+			if other, ok := series[key]; ok {
+				fail("register %s in block %s: same series as in block %s, %s_%s", r.Name, b.Name, other, p.Prefix, key)
+			}
+			series[key] = b.Name
+		}
+	}
+	return errs
+}
@@ -0,0 +1,64 @@
+package datakom
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDeviceProfileCheck(t *testing.T) {
+	for _, model := range slices.Sorted(maps.Keys(profiles)) {
+		t.Run(model, func(t *testing.T) {
+			if errs := profiles[model].Check(); len(errs) > 0 {
+				t.Errorf("Check() = %v, want no problems", errs)
+			}
+		})
+	}
+
+	reg := func(name string, offset int, labels ...Label) Register {
+		return Register{Name: name, Offset: offset, Divisor: 1, Labels: labels}
+	}
+	tests := []struct {
+		name   string
+		blocks []Block
+		want   []string // Substrings of the problems, in order
+	}{
+		{"valid", []Block{
+			{Name: "a", Address: 0, Count: 2, Registers: []Register{reg("x", 0), {Name: "y", Offset: 0, Type: Uint32, Divisor: 1}}},
+			{Name: "b", Address: 2, Count: 1, Registers: []Register{reg("z", 0)}},
+		}, nil},
+		{"duplicate block", []Block{{Name: "a", Count: 1}, {Name: "a", Address: 1, Count: 1}}, []string{"block a: defined more than once"}},
+		{"empty block", []Block{{Name: "a"}}, []string{"block a: no registers to read"}},
+		{"block over the read limit", []Block{{Name: "a", Count: 126}}, []string{"exceed the Modbus limit of 125"}},
+		{"block past the address space", []Block{{Name: "a", Address: 65530, Count: 10}}, []string{"exceed the Modbus address space"}},
+		{"register past the block", []Block{{Name: "a", Count: 2, Registers: []Register{{Name: "x", Offset: 1, Type: Uint32, Divisor: 1}}}},
+			[]string{"register x: uint32 value at offset 1 exceeds block a of 2 registers"}},
+		{"negative offset", []Block{{Name: "a", Count: 2, Registers: []Register{reg("x", -1)}}}, []string{"register x:"}},
+		{"overlapping blocks", []Block{{Name: "a", Address: 0, Count: 10}, {Name: "b", Address: 5, Count: 10}}, []string{"blocks a (0-9) and b (5-14) overlap"}},
+		{"overlap with an earlier block", []Block{
+			{Name: "a", Address: 0, Count: 20}, {Name: "b", Address: 2, Count: 2}, {Name: "c", Address: 10, Count: 2},
+		}, []string{"blocks a (0-19) and b (2-3) overlap", "blocks a (0-19) and c (10-11) overlap"}},
+		{"derived metric name", []Block{{Name: "a", Count: 1, Registers: []Register{reg("load_percent", 0)}}}, []string{"collides with the derived metric test_load_percent"}},
+		{"differing label names", []Block{{Name: "a", Count: 2, Registers: []Register{
+			reg("x", 0, Label{"phase", "L1"}), reg("x", 1, Label{"line", "L2"}),
+		}}}, []string{"label names [line] differ from [phase]"}},
+		{"duplicate series", []Block{
+			{Name: "a", Count: 1, Registers: []Register{reg("x", 0, Label{"phase", "L1"})}},
+			{Name: "b", Address: 1, Count: 1, Registers: []Register{reg("x", 0, Label{"phase", "L1"})}},
+		}, []string{"register x in block b: same series as in block a, test_x{L1}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := (&DeviceProfile{Prefix: "test", Blocks: tt.blocks}).Check()
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Check() = %v, want %d problems", errs, len(tt.want))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.want[i]) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package datakom
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+const blockSuccessHelp = "Whether the last read of the register block succeeded"
+
+// Client is the Modbus connection to a controller, opened for every session. It is
+// implemented by *modbus.ModbusClient, and by clients of transports the package lacks.
+type Client interface {
+	Open() error
+	Close() error
+	ReadRegister(addr uint16, regType modbus.RegType) (uint16, error)
+	ReadRegisters(addr, quantity uint16, regType modbus.RegType) ([]uint16, error)
+	WriteRegister(addr, value uint16) error
+}
+
+// Collector polls a controller over Modbus and exposes its readings as Prometheus metrics.
+// The exported fields may be set after NewCollector, before the collector is used.
+type Collector struct {
+	client  Client
+	name    string
+	profile *DeviceProfile
+
+	Retry   RetryPolicy       // Retries of failed reads, a single attempt if zero
+	Labels  map[string]string // Constant labels attached to readings, e.g. for outputs
+	Rating  RatingConfig      // Rated power for the load percentage, none if zero
+	Fuel    FuelConfig        // Tuning of the fuel consumption estimates
+	Service ServiceConfig     // When maintenance is due
+	MaxAge  time.Duration     // Age at which background readings are no longer served, never if zero
+
+	SeparateLink bool // Leaves the Modbus link metrics to the collector of Link, e.g. for a separate endpoint
+
+	MaxGap      uint16 // Unused registers a read may span to merge neighbouring blocks
+	MaxReadSize uint16 // Registers per read request, at most and by default 125
+
+	RequestDelay time.Duration // Pause between consecutive requests, for slow gateways and links
+	MinInterval  time.Duration // Minimum time between polls; scrapes within it are served the last reading
+
+	// Watchdog of the link: after every FailureThreshold consecutive failed polls, OnFailures
+	// is called with the failed polls since the last successful one, e.g. to power-cycle the
+	// link. Every session opens a fresh connection, so there is none to reset here.
+	FailureThreshold int
+	OnFailures       func(failures int)
+
+	// The controller accepts a single Modbus connection, so scrapes and
+	// ad-hoc reads are serialized
+	mu          sync.Mutex
+	lastRequest time.Time // End of the last request, for the request delay
+	failures    int       // Consecutive failed polls, for the watchdog
+
+	// Background polling state; scrapes are served from the latest reading while polling
+	pollMu   sync.Mutex
+	latest   *Reading
+	polling  bool
+	stop     chan struct{}
+	done     chan struct{} // Closed once the poll loop has returned
+	scrapeMu sync.Mutex    // Serializes polls on scrape, so concurrent scrapes share a poll
+
+	// Metric descriptors keyed by register name
+	descs        map[string]*prometheus.Desc
+	blockSuccess *prometheus.Desc
+	loadDesc     *prometheus.Desc // Nil if the profile has no total active power
+	fuelDescs    *fuelDescs       // Nil if the profile has no fuel level
+	serviceDesc  *prometheus.Desc
+	locationDesc *prometheus.Desc // Nil if the profile has no GPS position
+
+	split       map[string]bool // Merged reads rejected by the controller, read block by block
+	ratedKW     float64         // Rated power read from the controller, zero until read
+	fuelHistory []fuelPoint     // Fuel levels within the rate window, oldest first
+
+	// Modbus link instrumentation
+	readDuration *prometheus.HistogramVec
+	readErrors   *prometheus.CounterVec
+	watchdog     prometheus.Counter
+}
+
+// NewCollector initializes the collector of the named controller with metric descriptors
+// derived from the profile. Blocks of the profile that are disabled are not read.
+func NewCollector(client Client, name string, profile *DeviceProfile) *Collector {
+	// Optional blocks are only read once enabled through Configure
+	profile, _ = profile.applyOverrides(nil)
+	c := &Collector{
+		client:       client,
+		name:         name,
+		profile:      profile,
+		descs:        make(map[string]*prometheus.Desc),
+		split:        make(map[string]bool),
+		blockSuccess: prometheus.NewDesc(profile.Prefix+"_block_read_success", blockSuccessHelp, []string{"block"}, nil),
+		serviceDesc:  prometheus.NewDesc(profile.Prefix+"_service_due", serviceDueHelp, nil, nil),
+		readDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    profile.Prefix + "_modbus_read_duration_seconds",
+			Help:    "Duration of Modbus register read requests",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"block", "function_code"}),
+		readErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: profile.Prefix + "_modbus_read_errors_total",
+			Help: "Number of failed Modbus register read requests",
+		}, []string{"block", "function_code"}),
+		watchdog: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: profile.Prefix + "_watchdog_triggers_total",
+			Help: "Number of times the watchdog fired after consecutive failed polls",
+		}),
+	}
+	if profile.Power != "" {
+		c.loadDesc = prometheus.NewDesc(profile.Prefix+"_load_percent", loadHelp, nil, nil)
+	}
+	if profile.FuelLevel != "" {
+		c.fuelDescs = newFuelDescs(profile.Prefix, profile.BaseUnits)
+	}
+	c.locationDesc = newLocationDesc(profile)
+	for _, b := range profile.Blocks {
+		for _, r := range b.Registers {
+			if _, ok := c.descs[r.Name]; ok {
+				continue
+			}
+			c.descs[r.Name] = prometheus.NewDesc(profile.Prefix+"_"+r.Name, r.Help, r.labelNames(), nil)
+			if r.Codes != nil {
+				c.descs[r.Name+"_info"] = prometheus.NewDesc(profile.Prefix+"_"+r.Name+"_info", r.Help+", as text",
+					append(r.labelNames(), "code", "text"), nil)
+			}
+		}
+	}
+	return c
+}
+
+// Name returns the name of the controller, used as the target of its readings
+func (c *Collector) Name() string {
+	return c.name
+}
+
+// Profile returns the register map of the controller
+func (c *Collector) Profile() *DeviceProfile {
+	return c.profile
+}
+
+// Describe sends the descriptors of each metric over to Prometheus
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+	ch <- c.blockSuccess
+	ch <- c.serviceDesc
+	if c.loadDesc != nil {
+		ch <- c.loadDesc
+	}
+	if c.fuelDescs != nil {
+		ch <- c.fuelDescs.rate
+		ch <- c.fuelDescs.rateLiters
+		ch <- c.fuelDescs.runtime
+	}
+	if c.locationDesc != nil {
+		ch <- c.locationDesc
+	}
+	if !c.SeparateLink {
+		c.describeLink(ch)
+	}
+}
+
+// Link returns a collector of the Modbus link metrics alone: read latencies and errors, and
+// watchdog triggers. They are also collected by the collector itself unless SeparateLink is set.
+func (c *Collector) Link() prometheus.Collector {
+	return linkCollector{c}
+}
+
+type linkCollector struct{ c *Collector }
+
+func (l linkCollector) Describe(ch chan<- *prometheus.Desc) { l.c.describeLink(ch) }
+func (l linkCollector) Collect(ch chan<- prometheus.Metric) { l.c.collectLink(ch) }
+
+func (c *Collector) describeLink(ch chan<- *prometheus.Desc) {
+	c.readDuration.Describe(ch)
+	c.readErrors.Describe(ch)
+	c.watchdog.Describe(ch)
+}
+
+func (c *Collector) collectLink(ch chan<- prometheus.Metric) {
+	c.readDuration.Collect(ch)
+	c.readErrors.Collect(ch)
+	c.watchdog.Collect(ch)
+}
+
+// Session opens a connection to the controller, runs fn and closes the connection again.
+// Reads must be performed within a session.
+func (c *Collector) Session(fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.client.Open(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", c.name, err)
+	}
+	defer c.client.Close()
+	return fn()
+}
+
+// ReadRegisters reads a register range, recording the latency and failure of every attempt
+// under the block name. Failed reads are retried according to the retry policy, except when
+// the controller rejected the request.
+func (c *Collector) ReadRegisters(block string, addr, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	return c.readRegisters([]string{block}, addr, quantity, regType)
+}
+
+// readRegisters reads a register range covering the given blocks, recording every attempt
+// under each of them, so that the Modbus metrics keep the block names of the profile however
+// the reads are merged
+func (c *Collector) readRegisters(blocks []string, addr, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	fc := "3"
+	if regType == modbus.INPUT_REGISTER {
+		fc = "4"
+	}
+
+	for attempt := 1; ; attempt++ {
+		c.pace()
+		start := time.Now()
+		r, err := c.client.ReadRegisters(addr, quantity, regType)
+		c.lastRequest = time.Now()
+		for _, block := range blocks {
+			c.readDuration.WithLabelValues(block, fc).Observe(time.Since(start).Seconds())
+			if err != nil {
+				c.readErrors.WithLabelValues(block, fc).Inc()
+			}
+		}
+		if err == nil {
+			return r, nil
+		}
+		if attempt >= c.Retry.Attempts || !retryable(err) {
+			return r, err
+		}
+		delay := c.Retry.backoff(attempt)
+		log.Printf("Retrying read of block %s from %s in %s: %v", strings.Join(blocks, "+"), c.name, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+}
+
+// WriteRegister writes a single holding register. Like reads, writes must be performed
+// within a session; they are never retried, as commands must not be issued twice.
+func (c *Collector) WriteRegister(addr, value uint16) error {
+	c.pace()
+	defer func() { c.lastRequest = time.Now() }()
+	return c.client.WriteRegister(addr, value)
+}
+
+// pace waits until the request delay has passed since the last request
+func (c *Collector) pace() {
+	if c.RequestDelay > 0 {
+		time.Sleep(time.Until(c.lastRequest.Add(c.RequestDelay)))
+	}
+}
+
+// Command issues the named control write of the profile over the collector's connection
+func (c *Collector) Command(name string) error {
+	cmd, ok := c.profile.Commands[name]
+	if !ok {
+		return fmt.Errorf("unsupported command %q for model %s", name, c.profile.Model)
+	}
+	return c.Session(func() error {
+		return c.WriteRegister(cmd.Address, cmd.Value)
+	})
+}
+
+// backoff returns the delay before the retry following the given attempt: the delay
+// doubled for every earlier retry up to the maximum, reduced by a random jitter of up to half
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	d := r.Delay
+	for i := 1; i < attempt && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, r.MaxDelay)
+	return d - rand.N(d/2+1)
+}
+
+// retryable reports whether a failed read may succeed when repeated: transport errors
+// and timeouts, or the controller asking to be retried later
+func retryable(err error) bool {
+	code, ok := exceptionCode(err)
+	return !ok || code == 0x05 || code == 0x06
+}
+
+// Modbus exception codes of the errors returned by the client
+var exceptionCodes = map[error]uint8{
+	modbus.ErrIllegalFunction:         0x01,
+	modbus.ErrIllegalDataAddress:      0x02,
+	modbus.ErrIllegalDataValue:        0x03,
+	modbus.ErrServerDeviceFailure:     0x04,
+	modbus.ErrAcknowledge:             0x05,
+	modbus.ErrServerDeviceBusy:        0x06,
+	modbus.ErrMemoryParityError:       0x08,
+	modbus.ErrGWPathUnavailable:       0x0a,
+	modbus.ErrGWTargetFailedToRespond: 0x0b,
+}
+
+// exceptionCode returns the Modbus exception code reported by the controller, if err is one
+func exceptionCode(err error) (uint8, bool) {
+	for e, code := range exceptionCodes {
+		if errors.Is(err, e) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// Poll reads every block of the profile and decodes it, merging neighbouring blocks into
+// bulk reads. Failed blocks are logged and skipped, and the outcome of every block is
+// recorded in its success sample.
+func (c *Collector) Poll() (*Reading, error) {
+	reading := &Reading{Target: c.name, Model: c.profile.Model, Labels: c.Labels, Time: time.Now()}
+	err := c.Session(func() error {
+		for _, w := range c.windows() {
+			r, err := c.readWindow(w)
+			if _, ok := exceptionCode(err); ok && len(w.blocks) > 1 {
+				// The merged range spans registers the controller rejects
+				log.Printf("Reading blocks %s of %s separately: %v", w.name(), c.name, err)
+				c.split[w.name()] = true
+				for _, b := range w.blocks {
+					bw := readWindow{address: b.Address, count: b.Count, blocks: []*Block{b}}
+					r, err := c.readWindow(bw)
+					c.decodeWindow(reading, bw, r, err)
+				}
+				continue
+			}
+			c.decodeWindow(reading, w, r, err)
+		}
+		if s, ok := c.loadSample(reading.Samples); ok {
+			reading.Samples = append(reading.Samples, s)
+		}
+		reading.Samples = append(reading.Samples, c.fuelSamples(reading.Samples, reading.Time)...)
+		if s, ok := c.serviceSample(reading.Samples); ok {
+			reading.Samples = append(reading.Samples, s)
+		}
+		if s, ok := c.locationSample(reading.Samples); ok {
+			reading.Samples = append(reading.Samples, s)
+		}
+		return nil
+	})
+	if err != nil {
+		reading.Error = err.Error()
+		for _, b := range c.profile.Blocks {
+			reading.Samples = append(reading.Samples, c.blockSample(b.Name, false))
+		}
+	}
+	c.watch(reading, err)
+	return reading, err
+}
+
+// watch counts consecutive polls that failed to connect or to read any block, and fires
+// the watchdog after every FailureThreshold of them
+func (c *Collector) watch(reading *Reading, err error) {
+	if c.FailureThreshold <= 0 {
+		return
+	}
+	failed := err != nil || !slices.ContainsFunc(reading.Samples, func(s Sample) bool {
+		return s.desc == c.blockSuccess && s.Value == 1
+	})
+
+	c.mu.Lock()
+	if !failed {
+		c.failures = 0
+		c.mu.Unlock()
+		return
+	}
+	c.failures++
+	failures := c.failures
+	c.mu.Unlock()
+	if failures%c.FailureThreshold != 0 {
+		return
+	}
+
+	c.watchdog.Inc()
+	log.Printf("Watchdog of %s fired after %d failed polls", c.name, failures)
+	if c.OnFailures != nil {
+		c.OnFailures(failures)
+	}
+}
+
+// decodeWindow records the outcome of a window read and decodes the registers of its blocks
+func (c *Collector) decodeWindow(reading *Reading, w readWindow, r []uint16, err error) {
+	if err == nil && len(r) < int(w.count) {
+		err = fmt.Errorf("short response of %d registers", len(r))
+	}
+	for _, b := range w.blocks {
+		reading.Samples = append(reading.Samples, c.blockSample(b.Name, err == nil))
+	}
+	if err != nil {
+		if code, ok := exceptionCode(err); ok {
+			err = fmt.Errorf("%w (exception code 0x%02x)", err, code)
+		}
+		log.Printf("Failed to read block %s (%d registers at %d) from %s: %v", w.name(), w.count, w.address, c.name, err)
+		return
+	}
+	for _, b := range w.blocks {
+		regs := r[b.Address-w.address:][:b.Count]
+		for _, reg := range b.Registers {
+			value, labels := reg.sample(regs, b.WordOrder)
+			reading.Samples = append(reading.Samples, c.newSample(reg, value, labels))
+			if reg.Codes != nil {
+				reading.Samples = append(reading.Samples, c.codeSample(reg, value, labels))
+			}
+		}
+	}
+}
+
+// blockSample builds the success sample of a block read
+func (c *Collector) blockSample(block string, ok bool) Sample {
+	s := Sample{
+		Name:        c.profile.Prefix + "_block_read_success",
+		Labels:      map[string]string{"block": block},
+		help:        blockSuccessHelp,
+		desc:        c.blockSuccess,
+		valueType:   prometheus.GaugeValue,
+		labelValues: []string{block},
+	}
+	if ok {
+		s.Value = 1
+	}
+	return s
+}
+
+// newSample builds the sample of a decoded register value
+func (c *Collector) newSample(reg Register, value float64, labelValues []string) Sample {
+	s := Sample{
+		Name:        c.profile.Prefix + "_" + reg.Name,
+		Value:       value,
+		Unit:        reg.Unit(),
+		help:        reg.Help,
+		desc:        c.descs[reg.Name],
+		valueType:   reg.valueType(),
+		labelValues: labelValues,
+	}
+	if names := reg.labelNames(); len(names) > 0 {
+		s.Labels = make(map[string]string, len(names))
+		for i, name := range names {
+			s.Labels[name] = labelValues[i]
+		}
+	}
+	return s
+}
+
+// codeSample builds the _info sample of a register with code texts, labeled with the code
+// and its text, "unknown" if the code is not mapped
+func (c *Collector) codeSample(reg Register, value float64, labelValues []string) Sample {
+	code := int(value)
+	text, ok := reg.Codes[code]
+	if !ok {
+		text = "unknown"
+	}
+	info := reg
+	info.Name += "_info"
+	info.Help += ", as text"
+	info.Counter = false
+	s := c.newSample(info, 1, append(slices.Clone(labelValues), strconv.Itoa(code), text))
+	s.Unit = ""
+	if s.Labels == nil {
+		s.Labels = make(map[string]string, 2)
+	}
+	s.Labels["code"], s.Labels["text"] = strconv.Itoa(code), text
+	return s
+}
+
+// StartPolling polls the controller every interval in the background, caching the
+// reading for scrapes and handing it to the sinks
+func (c *Collector) StartPolling(interval time.Duration, sinks []Sink) {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	if c.polling {
+		return
+	}
+	c.polling = true
+	c.stop, c.done = make(chan struct{}), make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(max(interval, c.MinInterval))
+		defer ticker.Stop()
+		for {
+			reading, err := c.Poll()
+			if err != nil {
+				log.Print(err)
+			}
+			c.pollMu.Lock()
+			c.latest = reading
+			c.pollMu.Unlock()
+			for _, s := range sinks {
+				s.Publish(reading)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(c.stop, c.done)
+}
+
+// StopPolling ends background polling, waiting for a poll in progress to finish, so the
+// controller is no longer polled once it returns
+func (c *Collector) StopPolling() {
+	c.pollMu.Lock()
+	if !c.polling {
+		c.pollMu.Unlock()
+		return
+	}
+	close(c.stop)
+	c.polling = false
+	done := c.done
+	c.pollMu.Unlock()
+	<-done
+}
+
+// Reading returns the latest reading when polling in the background, or nil if it is older
+// than MaxAge, and otherwise polls the controller; nil if no poll has finished yet
+func (c *Collector) Reading() *Reading {
+	reading, _ := c.reading()
+	return reading
+}
+
+// reading returns the reading as Reading does, and whether it was taken from the cache
+func (c *Collector) reading() (*Reading, bool) {
+	c.pollMu.Lock()
+	reading, polling := c.latest, c.polling
+	c.pollMu.Unlock()
+
+	if !polling {
+		return c.scrape()
+	}
+	if reading != nil && c.MaxAge > 0 && time.Since(reading.Time) > c.MaxAge {
+		return nil, true
+	}
+	return reading, true
+}
+
+// scrape polls the controller for a scrape, unless the last poll was less than MinInterval ago
+func (c *Collector) scrape() (*Reading, bool) {
+	c.scrapeMu.Lock()
+	defer c.scrapeMu.Unlock()
+
+	if c.MinInterval > 0 {
+		c.pollMu.Lock()
+		latest := c.latest
+		c.pollMu.Unlock()
+		if latest != nil && time.Since(latest.Time) < c.MinInterval {
+			return latest, true
+		}
+	}
+
+	log.Printf("Starting scrape for target %s", c.name)
+	reading, err := c.Poll()
+	if err != nil {
+		log.Print(err)
+	}
+	c.pollMu.Lock()
+	c.latest = reading
+	c.pollMu.Unlock()
+	return reading, false
+}
+
+// Identify returns the profile matching the product code of the controller, or nil
+func (c *Collector) Identify() (*DeviceProfile, error) {
+	var p *DeviceProfile
+	err := c.Session(func() error {
+		p = Identify(c.client)
+		return nil
+	})
+	return p, err
+}
+
+// Collect serves the latest reading, timestamped with the time of the poll, when polling
+// in the background, and otherwise triggers the Modbus polling logic during every scrape request
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if reading, cached := c.reading(); reading != nil {
+		for _, s := range reading.Samples {
+			if cached {
+				ch <- prometheus.NewMetricWithTimestamp(reading.Time, s.Metric())
+			} else {
+				ch <- s.Metric()
+			}
+		}
+	}
+
+	if !c.SeparateLink {
+		c.collectLink(ch)
+	}
+}
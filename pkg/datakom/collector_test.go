@@ -0,0 +1,59 @@
+package datakom
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, Delay: 200 * time.Millisecond, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration // Before the jitter
+	}{
+		{"first retry", policy, 1, 200 * time.Millisecond},
+		{"doubled", policy, 2, 400 * time.Millisecond},
+		{"doubled twice", policy, 3, 800 * time.Millisecond},
+		{"capped", policy, 6, 5 * time.Second},
+		{"capped far out", policy, 100, 5 * time.Second},
+		{"delay above the maximum", RetryPolicy{Delay: 10 * time.Second, MaxDelay: time.Second}, 1, time.Second},
+		{"no delay", RetryPolicy{MaxDelay: time.Second}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The jitter takes off up to half of the delay
+			for range 100 {
+				if got := tt.policy.backoff(tt.attempt); got > tt.want || got < tt.want-tt.want/2 {
+					t.Fatalf("backoff(%d) = %v, want %v minus up to half", tt.attempt, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// sinkFunc publishes readings by calling the function
+type sinkFunc func(r *Reading)
+
+func (f sinkFunc) Publish(r *Reading) { f(r) }
+
+func TestStopPollingWaitsForPoll(t *testing.T) {
+	profile, err := Lookup("d500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := serveSimulator(t, profile)
+	c.RequestDelay = 20 * time.Millisecond // Polls lasting longer than the wait below
+
+	var polls atomic.Int32
+	c.StartPolling(time.Millisecond, []Sink{sinkFunc(func(*Reading) { polls.Add(1) })})
+	time.Sleep(50 * time.Millisecond)
+	c.StopPolling()
+	stopped := polls.Load()
+	time.Sleep(200 * time.Millisecond)
+	if n := polls.Load(); n != stopped || n == 0 {
+		t.Errorf("%d polls published after StopPolling returned with %d, want none after at least one", n-stopped, stopped)
+	}
+}
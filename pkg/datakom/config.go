@@ -0,0 +1,318 @@
+package datakom
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockConfig overrides the decoding of a register block of the device profile
+type BlockConfig struct {
+	Name      string           `yaml:"name"`
+	Enabled   *bool            `yaml:"enabled"` // Disabled blocks are not read, e.g. without mains CTs
+	WordOrder WordOrder        `yaml:"word_order"`
+	Registers []RegisterConfig `yaml:"registers"`
+}
+
+// RegisterConfig overrides the decoding of a register within a block
+type RegisterConfig struct {
+	Name    string   `yaml:"name"`
+	Type    DataType `yaml:"type"`
+	Divisor float64  `yaml:"divisor"`
+}
+
+// AnalogInputConfig names and scales a spare analog sender input
+type AnalogInputConfig struct {
+	Input   int      `yaml:"input"` // 1-based input number
+	Name    string   `yaml:"name"`
+	Type    DataType `yaml:"type"`
+	Divisor float64  `yaml:"divisor"`
+}
+
+// RetryPolicy retries failed register reads with exponential backoff and jitter
+type RetryPolicy struct {
+	Attempts int           `yaml:"attempts"`  // Attempts per read, defaults to 1 (no retries)
+	Delay    time.Duration `yaml:"delay"`     // Delay before the first retry, doubled for each further one; defaults to 200ms
+	MaxDelay time.Duration `yaml:"max_delay"` // Defaults to 5s
+}
+
+// UnitConfig selects the units of exported temperatures, durations and energies
+type UnitConfig struct {
+	Temperature string `yaml:"temperature"` // celsius (default), fahrenheit or both
+	BaseUnits   bool   `yaml:"base_units"`  // Prometheus base units: seconds, watts and joules
+}
+
+// Temperature unit options
+const (
+	Celsius    = "celsius"
+	Fahrenheit = "fahrenheit"
+	BothUnits  = "both"
+)
+
+// Base units replacing the units of metric names, with the factor converting to them. Day
+// counters are kept, as they would clash with the hour counters of the same value. The
+// fuel estimates switch to seconds as well, e.g. fuel_runtime_remaining_seconds.
+var baseUnits = map[string]struct {
+	name   string
+	factor float64
+}{
+	"hours": {"seconds", 3600},
+	"kw":    {"watts", 1000},
+	"kwh":   {"joules", 3.6e6},
+	"c":     {"celsius", 1},
+	"f":     {"fahrenheit", 1},
+}
+
+// Configure returns a copy of the profile with the block overrides and analog inputs applied,
+// and with the time zone of the controller clock set to loc unless nil
+func (p *DeviceProfile) Configure(blocks []BlockConfig, inputs []AnalogInputConfig, loc *time.Location) (*DeviceProfile, error) {
+	out, err := p.applyOverrides(blocks)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.addAnalogInputs(inputs); err != nil {
+		return nil, err
+	}
+	if loc != nil {
+		for i := range out.Blocks {
+			for j := range out.Blocks[i].Registers {
+				out.Blocks[i].Registers[j].Location = loc
+			}
+		}
+		out.EventLog.Location = loc
+	}
+	return out, nil
+}
+
+// MapCodes returns a copy of the profile with the texts of the codes of registers set, keyed
+// by register name, e.g. for the status code table of a firmware version. The texts of a
+// register replace its built-in ones.
+func (p *DeviceProfile) MapCodes(codes map[string]map[int]string) (*DeviceProfile, error) {
+	out, _ := p.applyOverrides(nil)
+	for name, texts := range codes {
+		found := false
+		for i := range out.Blocks {
+			for j := range out.Blocks[i].Registers {
+				if r := &out.Blocks[i].Registers[j]; r.Name == name {
+					r.Codes = texts
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("model %s has no register %q", p.Model, name)
+		}
+	}
+	return out, nil
+}
+
+// ConvertUnits returns a copy of the profile exporting temperatures in Fahrenheit, or in
+// both Celsius and Fahrenheit, and with values in base units if requested
+func (p *DeviceProfile) ConvertUnits(u UnitConfig) (*DeviceProfile, error) {
+	switch u.Temperature {
+	case "", Celsius, Fahrenheit, BothUnits:
+	default:
+		return nil, fmt.Errorf("invalid temperature unit %q, expected celsius, fahrenheit or both", u.Temperature)
+	}
+	out, _ := p.applyOverrides(nil)
+
+	for i := range out.Blocks {
+		b := &out.Blocks[i]
+		var regs []Register
+		for _, r := range b.Registers {
+			if r.Unit() == "°C" && u.Temperature != "" && u.Temperature != Celsius {
+				f := r
+				f.Name = renameUnit(r.Name, "c", "f")
+				f.Help = r.Help + " in Fahrenheit"
+				f.Divisor = divisor(r) / 1.8
+				f.Shift = r.Shift*1.8 + 32
+				if u.Temperature == BothUnits {
+					regs = append(regs, r)
+				}
+				r = f
+			}
+			regs = append(regs, r)
+		}
+
+		if u.BaseUnits {
+			for j := range regs {
+				r := &regs[j]
+				for from, to := range baseUnits {
+					if name := renameUnit(r.Name, from, to.name); name != r.Name {
+						if r.Name == out.Power {
+							out.Power = name
+						}
+						if r.Name == out.ServiceHours {
+							out.ServiceHours = name
+						}
+						r.Name = name
+						r.Divisor = divisor(*r) / to.factor
+						r.Shift *= to.factor
+						break
+					}
+				}
+			}
+		}
+		b.Registers = regs
+	}
+	out.BaseUnits = u.BaseUnits
+	return out, nil
+}
+
+// renameUnit replaces the unit component of a metric name, e.g. run_hours_total to
+// run_seconds_total; the name is returned unchanged if its unit differs
+func renameUnit(name, from, to string) string {
+	parts := strings.Split(name, "_")
+	for i := len(parts) - 1; i > 0; i-- {
+		if _, ok := nameUnits[parts[i]]; ok {
+			if parts[i] == from {
+				parts[i] = to
+			}
+			break
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// divisor returns the divisor of a register, treating an unset one as 1
+func divisor(r Register) float64 {
+	if r.Divisor == 0 {
+		return 1
+	}
+	return r.Divisor
+}
+
+// addAnalogInputs appends a block exporting the configured spare analog inputs
+func (p *DeviceProfile) addAnalogInputs(inputs []AnalogInputConfig) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	if p.AnalogInputs.Count == 0 {
+		return fmt.Errorf("model %s has no spare analog inputs", p.Model)
+	}
+
+	b := Block{Name: "analog_inputs", Address: p.AnalogInputs.Address, Count: uint16(p.AnalogInputs.Count)}
+	for _, in := range inputs {
+		if in.Input < 1 || in.Input > p.AnalogInputs.Count {
+			return fmt.Errorf("analog input %d out of range 1-%d", in.Input, p.AnalogInputs.Count)
+		}
+		if in.Name == "" {
+			return fmt.Errorf("analog input %d: name is required", in.Input)
+		}
+		if in.Type != "" && in.Type != Uint16 && in.Type != Int16 {
+			return fmt.Errorf("analog input %d: invalid type %q, expected uint16 or int16", in.Input, in.Type)
+		}
+		if in.Divisor < 0 {
+			return fmt.Errorf("analog input %d: divisor must be positive, got %g", in.Input, in.Divisor)
+		}
+
+		r := Register{
+			Name:    "analog_input",
+			Help:    "Spare analog sender input",
+			Offset:  in.Input - 1,
+			Type:    in.Type,
+			Divisor: in.Divisor,
+			Labels:  []Label{{"input", strconv.Itoa(in.Input)}, {"name", in.Name}},
+		}
+		if r.Type == "" {
+			r.Type = Int16
+		}
+		if r.Divisor == 0 {
+			r.Divisor = 1
+		}
+		b.Registers = append(b.Registers, r)
+	}
+	p.Blocks = append(p.Blocks, b)
+	return nil
+}
+
+// block returns the named block of the profile, or nil
+func (p *DeviceProfile) block(name string) *Block {
+	for i := range p.Blocks {
+		if p.Blocks[i].Name == name {
+			return &p.Blocks[i]
+		}
+	}
+	return nil
+}
+
+// register returns the first register of the profile with the given name, or nil
+func (p *DeviceProfile) register(name string) *Register {
+	for i := range p.Blocks {
+		for j := range p.Blocks[i].Registers {
+			if r := &p.Blocks[i].Registers[j]; r.Name == name {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// applyOverrides returns a copy of the profile with the configured block overrides applied
+// and the disabled blocks removed, including optional blocks not enabled by an override
+func (p *DeviceProfile) applyOverrides(overrides []BlockConfig) (*DeviceProfile, error) {
+	out := *p
+	out.Blocks = make([]Block, len(p.Blocks))
+	for i, b := range p.Blocks {
+		b.Registers = append([]Register(nil), b.Registers...)
+		out.Blocks[i] = b
+	}
+
+	// Later overrides of a block take precedence, e.g. those of a target over the global ones
+	for _, o := range overrides {
+		b := out.block(o.Name)
+		if b == nil {
+			return nil, fmt.Errorf("model %s has no register block %q", p.Model, o.Name)
+		}
+		if !o.WordOrder.valid() {
+			return nil, fmt.Errorf("block %s: invalid word order %q", o.Name, o.WordOrder)
+		}
+		if o.WordOrder != "" {
+			b.WordOrder = o.WordOrder
+		}
+		if o.Enabled != nil {
+			b.Disabled = !*o.Enabled
+		}
+
+		for _, ro := range o.Registers {
+			if !ro.Type.valid() {
+				return nil, fmt.Errorf("register %s: invalid type %q", ro.Name, ro.Type)
+			}
+			if ro.Divisor < 0 {
+				return nil, fmt.Errorf("register %s: divisor must be positive, got %g", ro.Name, ro.Divisor)
+			}
+			found := false
+			// Registers sharing a name (e.g. one per phase) are overridden together
+			for i := range b.Registers {
+				r := &b.Registers[i]
+				if r.Name != ro.Name {
+					continue
+				}
+				found = true
+				if ro.Type != "" && ((ro.Type == String) != (r.Type == String) || (ro.Type == DateTime) != (r.Type == DateTime)) {
+					return nil, fmt.Errorf("register %s: cannot convert %s to %s", r.Name, r.Type, ro.Type)
+				}
+				if ro.Type != "" {
+					r.Type = ro.Type
+				}
+				if ro.Divisor != 0 {
+					r.Divisor = ro.Divisor
+				}
+				if r.Offset+r.size() > int(b.Count) {
+					return nil, fmt.Errorf("register %s: %s value at offset %d exceeds block %s", r.Name, r.Type, r.Offset, b.Name)
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("block %s has no register %q", o.Name, ro.Name)
+			}
+		}
+	}
+	out.Blocks = slices.DeleteFunc(out.Blocks, func(b Block) bool { return b.Disabled })
+	// The GPS position is unknown without its registers
+	if out.register(out.Latitude) == nil || out.register(out.Longitude) == nil {
+		out.Latitude, out.Longitude, out.Altitude = "", "", ""
+	}
+	return &out, nil
+}
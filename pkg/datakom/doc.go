@@ -0,0 +1,25 @@
+// Package datakom reads Datakom generator controllers over Modbus TCP and decodes their
+// registers into readings. It holds the register maps of the supported models, the
+// Prometheus collector used by datakom_exporter and a simulator of the controllers.
+//
+// A collector polls a single controller, which accepts only one Modbus connection at a time:
+//
+//	client, err := modbus.NewClient(&modbus.ClientConfiguration{URL: "tcp://192.168.100.100:502"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	profile, err := datakom.Lookup("d500")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	c := datakom.NewCollector(client, "genset-1", profile)
+//	reading, err := c.Poll()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	for _, s := range reading.Samples {
+//		fmt.Println(s.Name, s.Labels, s.Value, s.Unit)
+//	}
+//
+// The collector implements prometheus.Collector and may be registered directly.
+package datakom
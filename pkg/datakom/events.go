@@ -0,0 +1,105 @@
+package datakom
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+// Event records are fixed-size and a page of them must fit a single Modbus request
+const (
+	eventRecordSize = 16
+	eventsPerPage   = 125 / eventRecordSize
+)
+
+// EventLog locates the controller's circular event record buffer
+type EventLog struct {
+	CountAddress uint16 // 32-bit count of events recorded so far, low word first
+	Address      uint16 // First register of record slot 0
+	Capacity     int    // Number of record slots; event n is kept in slot n % Capacity
+
+	Location *time.Location // Time zone of the record timestamps, defaults to the host zone
+}
+
+// Event is a single decoded event record
+type Event struct {
+	Index       uint32    `json:"index"`
+	Time        time.Time `json:"time"`
+	Type        uint16    `json:"type"`
+	OpStatus    uint16    `json:"op_status"`
+	RunHours    float64   `json:"run_hours"`
+	BatteryV    float64   `json:"battery_v"`
+	CoolantTemp float64   `json:"coolant_temp_c"`
+	FuelPercent float64   `json:"fuel_percent"`
+}
+
+// decodeEvent decodes one record:
+// type, op status, date/time (6 registers), run hours (32-bit / 100), battery (/ 100), coolant (signed / 10), fuel (/ 10)
+func (l EventLog) decodeEvent(index uint32, r []uint16) Event {
+	loc := l.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	return Event{
+		Index:       index,
+		Time:        time.Date(int(r[2]), time.Month(r[3]), int(r[4]), int(r[5]), int(r[6]), int(r[7]), 0, loc),
+		Type:        r[0],
+		OpStatus:    r[1],
+		RunHours:    float64(getUint32(r, 8, LowWordFirst)) / 100.0,
+		BatteryV:    float64(r[10]) / 100.0,
+		CoolantTemp: float64(int16(r[11])) / 10.0,
+		FuelPercent: float64(r[12]) / 10.0,
+	}
+}
+
+// read returns the total number of recorded events and up to limit of the most recent ones, newest first
+func (l EventLog) read(c *Collector, limit int) (uint32, []Event, error) {
+	r, err := c.ReadRegisters("event_log", l.CountAddress, 2, modbus.HOLDING_REGISTER)
+	if err != nil {
+		return 0, nil, err
+	}
+	total := getUint32(r, 0, LowWordFirst)
+
+	n := uint32(min(limit, l.Capacity))
+	if total < n {
+		n = total
+	}
+
+	events := make([]Event, 0, n)
+	for k := total - n; k < total; {
+		// Page through contiguous slots without wrapping around the buffer
+		slot := int(k % uint32(l.Capacity))
+		count := min(eventsPerPage, int(total-k), l.Capacity-slot)
+
+		r, err := c.ReadRegisters("event_log", l.Address+uint16(slot*eventRecordSize), uint16(count*eventRecordSize), modbus.HOLDING_REGISTER)
+		if err != nil {
+			return total, nil, err
+		}
+		for i := 0; i < count && (i+1)*eventRecordSize <= len(r); i++ {
+			events = append(events, l.decodeEvent(k+uint32(i), r[i*eventRecordSize:(i+1)*eventRecordSize]))
+		}
+		k += uint32(count)
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return total, events, nil
+}
+
+// Events returns the total number of recorded events and up to limit of the most recent
+// ones, newest first
+func (c *Collector) Events(limit int) (uint32, []Event, error) {
+	l := c.profile.EventLog
+	if l.Capacity == 0 {
+		return 0, nil, fmt.Errorf("event log not supported by model %s", c.profile.Model)
+	}
+	var total uint32
+	var events []Event
+	err := c.Session(func() (err error) {
+		total, events, err = l.read(c, limit)
+		return err
+	})
+	return total, events, err
+}
@@ -0,0 +1,138 @@
+package datakom
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	fuelRateHelp       = "Fuel consumption rate, relative to the tank capacity"
+	fuelRateLitersHelp = "Fuel consumption rate"
+	fuelRuntimeHelp    = "Estimated remaining runtime at the current fuel consumption rate"
+)
+
+// Default window of fuel level history the consumption rate is derived from
+const defaultFuelWindow = time.Hour
+
+// Rise of the fuel level, in percent, taken as a refill rather than sender noise
+const fuelRefillThreshold = 2
+
+// FuelConfig tunes the fuel consumption rate and remaining runtime estimates, derived
+// from the fuel level unless the controller provides the rate
+type FuelConfig struct {
+	TankLiters   float64       `yaml:"tank_liters"`   // Usable tank capacity, for rates in liters
+	Window       time.Duration `yaml:"window"`        // History of fuel levels the rate is derived from, defaults to 1h
+	RateRegister uint16        `yaml:"rate_register"` // Register holding the fuel rate in l/h, e.g. from the engine ECU
+	RateDivisor  float64       `yaml:"rate_divisor"`  // Of the rate register, defaults to 1
+}
+
+// Validate checks the tank capacity, window and divisor
+func (f FuelConfig) Validate() error {
+	if f.TankLiters < 0 || f.Window < 0 || f.RateDivisor < 0 {
+		return fmt.Errorf("tank_liters, window and rate_divisor must be positive")
+	}
+	return nil
+}
+
+// fuelPoint is a polled fuel level
+type fuelPoint struct {
+	time  time.Time
+	level float64
+}
+
+// fuelDescs are the descriptors of the fuel estimates, per hour or in base units per second
+type fuelDescs struct {
+	rate, rateLiters, runtime *prometheus.Desc
+	unit                      string // Time unit of the estimates, h or s
+}
+
+func newFuelDescs(prefix string, base bool) *fuelDescs {
+	unit, name := "h", "hour"
+	if base {
+		unit, name = "s", "second"
+	}
+	return &fuelDescs{
+		rate:       prometheus.NewDesc(prefix+"_fuel_rate_percent_per_"+name, fuelRateHelp, nil, nil),
+		rateLiters: prometheus.NewDesc(prefix+"_fuel_rate_liters_per_"+name, fuelRateLitersHelp, nil, nil),
+		runtime:    prometheus.NewDesc(prefix+"_fuel_runtime_remaining_"+name+"s", fuelRuntimeHelp, nil, nil),
+		unit:       unit,
+	}
+}
+
+// fuelSamples records the fuel level of the reading and estimates the consumption rate and
+// remaining runtime, once enough history is available. It must be called within a session.
+func (c *Collector) fuelSamples(samples []Sample, now time.Time) []Sample {
+	if c.fuelDescs == nil {
+		return nil
+	}
+	level, ok := 0.0, false
+	name := c.profile.Prefix + "_" + c.profile.FuelLevel
+	for _, s := range samples {
+		if s.Name == name {
+			level, ok = s.Value, true
+			break
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	window := c.Fuel.Window
+	if window == 0 {
+		window = defaultFuelWindow
+	}
+	if n := len(c.fuelHistory); n > 0 && level > c.fuelHistory[n-1].level+fuelRefillThreshold {
+		c.fuelHistory = c.fuelHistory[:0]
+	}
+	c.fuelHistory = append(c.fuelHistory, fuelPoint{now, level})
+	for len(c.fuelHistory) > 1 && now.Sub(c.fuelHistory[0].time) > window {
+		c.fuelHistory = c.fuelHistory[1:]
+	}
+
+	percent, liters := -1.0, -1.0
+	tank := c.Fuel.TankLiters
+	if c.Fuel.RateRegister != 0 {
+		regs, err := c.ReadRegisters("fuel_rate", c.Fuel.RateRegister, 1, modbus.HOLDING_REGISTER)
+		if err != nil || len(regs) < 1 {
+			log.Printf("Failed to read fuel rate from %s: %v", c.name, err)
+			return nil
+		}
+		div := c.Fuel.RateDivisor
+		if div == 0 {
+			div = 1
+		}
+		liters = float64(regs[0]) / div
+		if tank > 0 {
+			percent = 100 * liters / tank
+		}
+	} else if first, last := c.fuelHistory[0], c.fuelHistory[len(c.fuelHistory)-1]; last.time.Sub(first.time) >= window/4 {
+		percent = max(0, (first.level-last.level)/last.time.Sub(first.time).Hours())
+		if tank > 0 {
+			liters = percent * tank / 100
+		}
+	}
+
+	// The rates above are per hour
+	d, scale, name := c.fuelDescs, 1.0, "hour"
+	if d.unit == "s" {
+		scale, name = 1.0/3600, "second"
+	}
+	var out []Sample
+	add := func(desc *prometheus.Desc, name, help, unit string, v float64) {
+		out = append(out, Sample{Name: c.profile.Prefix + name, Value: v, Unit: unit, help: help, desc: desc, valueType: prometheus.GaugeValue})
+	}
+	if percent >= 0 {
+		add(d.rate, "_fuel_rate_percent_per_"+name, fuelRateHelp, "%/"+d.unit, percent*scale)
+	}
+	if liters >= 0 {
+		add(d.rateLiters, "_fuel_rate_liters_per_"+name, fuelRateLitersHelp, "l/"+d.unit, liters*scale)
+	}
+	if percent > 0 {
+		add(d.runtime, "_fuel_runtime_remaining_"+name+"s", fuelRuntimeHelp, d.unit, level/percent/scale)
+	}
+	return out
+}
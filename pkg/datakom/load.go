@@ -0,0 +1,110 @@
+package datakom
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+const loadHelp = "Genset active power relative to its rated power"
+
+// Power factor applied to kVA ratings, the standard rating of generating sets
+const defaultPowerFactor = 0.8
+
+// RatingConfig sets the rated power of the genset that its load percentage is computed
+// against: configured in kW or kVA, or read from a holding register of the controller
+type RatingConfig struct {
+	PowerKW     float64 `yaml:"power_kw"`
+	KVA         float64 `yaml:"kva"`
+	PowerFactor float64 `yaml:"power_factor"` // Applied to kva, defaults to 0.8
+	Register    uint16  `yaml:"register"`     // Register holding the rated power in kW, if not configured
+	Divisor     float64 `yaml:"divisor"`      // Of the register, defaults to 1
+}
+
+// Validate checks that at most one source of the rating is set
+func (r RatingConfig) Validate() error {
+	n := 0
+	for _, set := range []bool{r.PowerKW != 0, r.KVA != 0, r.Register != 0} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return fmt.Errorf("only one of power_kw, kva and register may be set")
+	case r.PowerKW < 0 || r.KVA < 0 || r.PowerFactor < 0 || r.PowerFactor > 1 || r.Divisor < 0:
+		return fmt.Errorf("ratings, power factor and divisor must be positive, power factor at most 1")
+	}
+	return nil
+}
+
+// configured reports whether a rating source is set
+func (r RatingConfig) configured() bool {
+	return r.PowerKW != 0 || r.KVA != 0 || r.Register != 0
+}
+
+// ratedPower returns the rated power in kW, reading it from the controller once if needed.
+// It must be called within a session.
+func (c *Collector) ratedPower() (float64, error) {
+	r := c.Rating
+	switch {
+	case r.PowerKW != 0:
+		return r.PowerKW, nil
+	case r.KVA != 0:
+		pf := r.PowerFactor
+		if pf == 0 {
+			pf = defaultPowerFactor
+		}
+		return r.KVA * pf, nil
+	case c.ratedKW != 0:
+		return c.ratedKW, nil
+	}
+
+	regs, err := c.ReadRegisters("rating", r.Register, 1, modbus.HOLDING_REGISTER)
+	if err != nil {
+		return 0, err
+	}
+	if len(regs) < 1 || regs[0] == 0 {
+		return 0, fmt.Errorf("no rated power in register %d", r.Register)
+	}
+	div := r.Divisor
+	if div == 0 {
+		div = 1
+	}
+	c.ratedKW = float64(regs[0]) / div
+	return c.ratedKW, nil
+}
+
+// loadSample computes the load percentage from the total active power sample, if the
+// rating is known and the power was read
+func (c *Collector) loadSample(samples []Sample) (Sample, bool) {
+	if c.loadDesc == nil || !c.Rating.configured() {
+		return Sample{}, false
+	}
+	name := c.profile.Prefix + "_" + c.profile.Power
+	for _, s := range samples {
+		if s.Name != name {
+			continue
+		}
+		rated, err := c.ratedPower()
+		if err != nil {
+			log.Printf("Failed to read rated power from %s: %v", c.name, err)
+			return Sample{}, false
+		}
+		kw := s.Value
+		if s.Unit == "W" {
+			kw /= 1000
+		}
+		return Sample{
+			Name:      c.profile.Prefix + "_load_percent",
+			Value:     100 * kw / rated,
+			Unit:      "%",
+			help:      loadHelp,
+			desc:      c.loadDesc,
+			valueType: prometheus.GaugeValue,
+		}, true
+	}
+	return Sample{}, false
+}
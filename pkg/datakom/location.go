@@ -0,0 +1,51 @@
+package datakom
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const locationHelp = "GPS position of the genset in the latitude, longitude and altitude labels, for geomap panels"
+
+// newLocationDesc returns the descriptor of the location info, or nil if the profile
+// has no GPS position
+func newLocationDesc(p *DeviceProfile) *prometheus.Desc {
+	if p.Latitude == "" || p.Longitude == "" {
+		return nil
+	}
+	return prometheus.NewDesc(p.Prefix+"_location_info", locationHelp, []string{"latitude", "longitude", "altitude"}, nil)
+}
+
+// locationSample exports the GPS position of the reading as labels of a constant 1. It is
+// left out without a position fix, reported by the controller as 0° latitude and longitude,
+// or if the position was not read.
+func (c *Collector) locationSample(samples []Sample) (Sample, bool) {
+	if c.locationDesc == nil {
+		return Sample{}, false
+	}
+	values := make(map[string]float64)
+	for _, s := range samples {
+		values[s.Name] = s.Value
+	}
+	prefix := c.profile.Prefix + "_"
+	lat, okLat := values[prefix+c.profile.Latitude]
+	lon, okLon := values[prefix+c.profile.Longitude]
+	if !okLat || !okLon || lat == 0 && lon == 0 {
+		return Sample{}, false
+	}
+	alt := ""
+	if v, ok := values[prefix+c.profile.Altitude]; ok && c.profile.Altitude != "" {
+		alt = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	labels := []string{strconv.FormatFloat(lat, 'f', 6, 64), strconv.FormatFloat(lon, 'f', 6, 64), alt}
+	return Sample{
+		Name:        prefix + "location_info",
+		Labels:      map[string]string{"latitude": labels[0], "longitude": labels[1], "altitude": labels[2]},
+		Value:       1,
+		help:        locationHelp,
+		desc:        c.locationDesc,
+		valueType:   prometheus.GaugeValue,
+		labelValues: labels,
+	}, true
+}
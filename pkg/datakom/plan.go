@@ -0,0 +1,93 @@
+package datakom
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/simonvetter/modbus"
+)
+
+// Largest number of registers in a single Modbus read request
+const maxReadSize = 125
+
+// readWindow is a register range read in a single request, covering one or more blocks
+type readWindow struct {
+	address uint16
+	count   uint16
+	blocks  []*Block
+}
+
+// name identifies the window in logs and in the reads rejected by the controller
+func (w readWindow) name() string {
+	names := make([]string, len(w.blocks))
+	for i, b := range w.blocks {
+		names[i] = b.Name
+	}
+	return strings.Join(names, "+")
+}
+
+// readSize returns the largest number of registers read in a single request
+func (c *Collector) readSize() int {
+	if c.MaxReadSize == 0 || c.MaxReadSize > maxReadSize {
+		return maxReadSize
+	}
+	return int(c.MaxReadSize)
+}
+
+// windows groups the blocks of the profile into read requests: blocks at most MaxGap
+// registers apart are merged while the request stays within MaxReadSize, and blocks above
+// it are left for readWindow to read in parts. Windows the controller rejected before are
+// read block by block.
+func (c *Collector) windows() []readWindow {
+	size := c.readSize()
+	blocks := make([]*Block, len(c.profile.Blocks))
+	for i := range c.profile.Blocks {
+		blocks[i] = &c.profile.Blocks[i]
+	}
+	slices.SortStableFunc(blocks, func(a, b *Block) int { return int(a.Address) - int(b.Address) })
+
+	var windows []readWindow
+	for _, b := range blocks {
+		if n := len(windows); n > 0 {
+			w := &windows[n-1]
+			end := int(w.address) + int(w.count)
+			if int(b.Address) <= end+int(c.MaxGap) && int(b.Address)+int(b.Count)-int(w.address) <= size {
+				w.count = uint16(max(end, int(b.Address)+int(b.Count)) - int(w.address))
+				w.blocks = append(w.blocks, b)
+				continue
+			}
+		}
+		windows = append(windows, readWindow{address: b.Address, count: b.Count, blocks: []*Block{b}})
+	}
+
+	var out []readWindow
+	for _, w := range windows {
+		if len(w.blocks) == 1 || !c.split[w.name()] {
+			out = append(out, w)
+			continue
+		}
+		for _, b := range w.blocks {
+			out = append(out, readWindow{address: b.Address, count: b.Count, blocks: []*Block{b}})
+		}
+	}
+	return out
+}
+
+// readWindow reads the registers of the window, recorded in the Modbus link metrics under
+// each of its blocks. A block larger than the read size is read in several requests.
+func (c *Collector) readWindow(w readWindow) ([]uint16, error) {
+	names := make([]string, len(w.blocks))
+	for i, b := range w.blocks {
+		names[i] = b.Name
+	}
+	size := c.readSize()
+	regs := make([]uint16, 0, w.count)
+	for addr, end := int(w.address), int(w.address)+int(w.count); addr < end; addr += size {
+		r, err := c.readRegisters(names, uint16(addr), uint16(min(size, end-addr)), modbus.HOLDING_REGISTER)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, r...)
+	}
+	return regs, nil
+}
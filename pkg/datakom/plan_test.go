@@ -0,0 +1,127 @@
+package datakom
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+func TestCollectorWindows(t *testing.T) {
+	blocks := []Block{
+		{Name: "a", Address: 100, Count: 10},
+		{Name: "b", Address: 112, Count: 10},
+		{Name: "c", Address: 200, Count: 20},
+	}
+	tests := []struct {
+		name    string
+		blocks  []Block
+		maxGap  uint16
+		maxSize uint16
+		split   []string // Merged windows the controller rejected
+		want    []string // name@address+count
+	}{
+		{"no gap allowed", blocks, 0, 0, nil, []string{"a@100+10", "b@112+10", "c@200+20"}},
+		{"gap bridged", blocks, 2, 0, nil, []string{"a+b@100+22", "c@200+20"}},
+		{"gap too wide", blocks, 1, 0, nil, []string{"a@100+10", "b@112+10", "c@200+20"}},
+		{"all merged", blocks, 100, 0, nil, []string{"a+b+c@100+120"}},
+		{"limited by the read size", blocks, 100, 60, nil, []string{"a+b@100+22", "c@200+20"}},
+		{"read size above the Modbus limit", blocks, 200, 500, nil, []string{"a+b+c@100+120"}},
+		{"sorted by address", []Block{blocks[2], blocks[0], blocks[1]}, 2, 0, nil, []string{"a+b@100+22", "c@200+20"}},
+		{"overlapping blocks", []Block{{Name: "a", Address: 100, Count: 10}, {Name: "b", Address: 105, Count: 2}}, 0, 0, nil, []string{"a+b@100+10"}},
+		{"rejected window split", blocks, 2, 0, []string{"a+b"}, []string{"a@100+10", "b@112+10", "c@200+20"}},
+		{"other window unaffected", blocks, 100, 0, []string{"a+b"}, []string{"a+b+c@100+120"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(nil, "test", &DeviceProfile{Prefix: "test", Blocks: tt.blocks})
+			c.MaxGap, c.MaxReadSize = tt.maxGap, tt.maxSize
+			for _, name := range tt.split {
+				c.split[name] = true
+			}
+			var got []string
+			for _, w := range c.windows() {
+				got = append(got, fmt.Sprintf("%s@%d+%d", w.name(), w.address, w.count))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("windows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMetricsPerBlock(t *testing.T) {
+	profile, err := Lookup("d500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := serveSimulator(t, profile)
+	c.MaxGap = 1000 // Merging all blocks within the read size
+	if _, err := c.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.readDuration)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range families[0].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "block" {
+				got = append(got, l.GetValue())
+			}
+		}
+	}
+	var want []string
+	for _, b := range c.Profile().Blocks {
+		want = append(want, b.Name)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("block labels = %v, want the profile blocks %v", got, want)
+	}
+}
+
+// requestRecorder records the sizes of the read requests served by the simulator
+type requestRecorder struct {
+	*Simulator
+	sizes []uint16
+}
+
+func (r *requestRecorder) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	r.sizes = append(r.sizes, req.Quantity)
+	return r.Simulator.HandleHoldingRegisters(req)
+}
+
+func TestReadWindowChunks(t *testing.T) {
+	profile, err := Lookup("d500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &requestRecorder{Simulator: NewSimulator(profile)}
+	c := NewCollector(serve(t, rec), "sim", profile)
+	c.MaxReadSize = 10 // Smaller than the engine and status blocks
+	reading, err := c.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range reading.Samples {
+		if s.desc == c.blockSuccess && s.Value != 1 {
+			t.Errorf("block %s: read failed", s.Labels["block"])
+		}
+		// At offset 25 of the engine block, in its third request
+		if s.Name == "d500_fuel_percent" && math.Abs(s.Value-80) > 0.1 {
+			t.Errorf("fuel_percent = %g, want 80", s.Value)
+		}
+	}
+	if i := slices.IndexFunc(rec.sizes, func(n uint16) bool { return n > c.MaxReadSize }); i >= 0 {
+		t.Errorf("read of %d registers, want at most %d", rec.sizes[i], c.MaxReadSize)
+	}
+}
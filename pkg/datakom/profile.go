@@ -0,0 +1,723 @@
+package datakom
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+// DataType selects how the raw register words are interpreted
+type DataType string
+
+const (
+	Uint16  DataType = "uint16"
+	Int16   DataType = "int16"
+	Uint32  DataType = "uint32"
+	Int32   DataType = "int32"
+	Float32 DataType = "float32"
+	String  DataType = "string" // ASCII text, two characters per register, exported as an info label
+
+	// DateTime spans six registers (year, month, day, hour, minute, second) of the
+	// controller's real-time clock and is exported as its offset from the host clock
+	DateTime DataType = "datetime"
+)
+
+// WordOrder selects the order of the two 16-bit words of a 32-bit value
+type WordOrder string
+
+const (
+	LowWordFirst  WordOrder = "low_first"
+	HighWordFirst WordOrder = "high_first"
+)
+
+// Register describes a single value decoded from a register block
+type Register struct {
+	Name    string   // Metric name without the model prefix
+	Help    string   // Metric help text
+	Offset  int      // Position within the block, in 16-bit words
+	Type    DataType // Defaults to uint16
+	Divisor float64  // Raw value is divided by this to obtain real units
+	Shift   float64  // Added to the scaled value, e.g. when converting temperature units
+	Mask    uint16   // When set, the value is 1 if any of the masked bits is set
+	Field   bool     // With Mask, the value is the masked bits shifted down instead, e.g. a position
+	Labels  []Label  // Optional variable labels (e.g. "phase")
+	Counter bool     // Exported as a counter instead of a gauge
+
+	// Texts of the values, e.g. of status codes, exported as a _info metric with the value
+	// in its code label and the text in its text label
+	Codes map[int]string
+
+	// String values are exported as a constant 1 with the text in InfoLabel
+	Length    int // Length of string values, in 16-bit words
+	InfoLabel string
+
+	Location *time.Location // Time zone of DateTime values, defaults to the host zone
+}
+
+// Label is a variable label name and value pair attached to a register
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Block is a contiguous range of holding registers read in a single request
+type Block struct {
+	Name      string
+	Address   uint16
+	Count     uint16
+	WordOrder WordOrder // Defaults to low word first
+	Registers []Register
+	Disabled  bool // Of optional hardware, read only once enabled in the block overrides
+}
+
+// DeviceProfile describes the register map of a specific controller model
+type DeviceProfile struct {
+	Model        string
+	Prefix       string // Metric name prefix, so mixed fleets yield distinct series
+	Blocks       []Block
+	AnalogInputs AnalogInputs
+	EventLog     EventLog
+	Identity     Identity
+	Commands     map[string]Command // Control writes by name, empty if the model accepts none
+	Power        string             // Name of the total active power register, for the load percentage
+	FuelLevel    string             // Name of the fuel level register, for the consumption estimates
+	ServiceHours string             // Names of the remaining service counters, for the service due state
+	ServiceDays  string
+	Latitude     string // Names of the GPS position registers, for the location info
+	Longitude    string
+	Altitude     string
+	BaseUnits    bool // Derived metrics in base units, set by ConvertUnits
+}
+
+// Identity is the product code register used to recognize the model during discovery
+type Identity struct {
+	Address uint16
+	Code    uint16 // Zero if the model cannot be discovered
+}
+
+// Command is a control write simulating a front panel button: the value written to the
+// command register
+type Command struct {
+	Address uint16
+	Value   uint16
+	Help    string
+}
+
+// AnalogInputs locates the spare analog sender registers, one 16-bit register per input
+type AnalogInputs struct {
+	Address uint16
+	Count   int
+}
+
+// words returns the number of 16-bit registers occupied by the data type
+func (t DataType) words() int {
+	switch t {
+	case Uint32, Int32, Float32:
+		return 2
+	case DateTime:
+		return 6
+	}
+	return 1
+}
+
+// valid reports whether the data type is known
+func (t DataType) valid() bool {
+	switch t {
+	case "", Uint16, Int16, Uint32, Int32, Float32, String, DateTime:
+		return true
+	}
+	return false
+}
+
+// size returns the number of 16-bit registers occupied by the register value
+func (r Register) size() int {
+	if r.Type == String {
+		return r.Length
+	}
+	return r.Type.words()
+}
+
+// valid reports whether the word order is known
+func (o WordOrder) valid() bool {
+	switch o {
+	case "", LowWordFirst, HighWordFirst:
+		return true
+	}
+	return false
+}
+
+// value decodes the register from the raw block contents
+func (r Register) value(regs []uint16, order WordOrder) float64 {
+	var raw uint32
+	if r.Type.words() == 2 {
+		raw = getUint32(regs, r.Offset, order)
+	} else if r.Offset < len(regs) {
+		raw = uint32(regs[r.Offset])
+	}
+
+	if r.Mask != 0 {
+		if r.Field {
+			return float64(raw & uint32(r.Mask) >> bits.TrailingZeros16(r.Mask))
+		}
+		if raw&uint32(r.Mask) != 0 {
+			return 1
+		}
+		return 0
+	}
+
+	var v float64
+	switch r.Type {
+	case Int16:
+		v = float64(int16(raw))
+	case Int32:
+		v = float64(int32(raw))
+	case Float32:
+		v = float64(math.Float32frombits(raw))
+	default:
+		v = float64(raw)
+	}
+	return v/r.Divisor + r.Shift
+}
+
+// sample decodes the register into a metric value and its variable label values
+func (r Register) sample(regs []uint16, order WordOrder) (float64, []string) {
+	switch r.Type {
+	case String:
+		return 1, append(r.labelValues(), r.text(regs))
+	case DateTime:
+		return r.clockOffset(regs, time.Now()), r.labelValues()
+	}
+	return r.value(regs, order), r.labelValues()
+}
+
+// clockOffset returns how far the controller clock is ahead of now, in seconds
+func (r Register) clockOffset(regs []uint16, now time.Time) float64 {
+	if len(regs) < r.Offset+6 {
+		return 0
+	}
+	loc := r.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	f := regs[r.Offset : r.Offset+6]
+	t := time.Date(int(f[0]), time.Month(f[1]), int(f[2]), int(f[3]), int(f[4]), int(f[5]), 0, loc)
+	return t.Sub(now).Seconds()
+}
+
+// text decodes an ASCII string register, high byte first, trimming padding
+func (r Register) text(regs []uint16) string {
+	b := make([]byte, 0, 2*r.Length)
+	for i := r.Offset; i < r.Offset+r.Length && i < len(regs); i++ {
+		b = append(b, byte(regs[i]>>8), byte(regs[i]))
+	}
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// valueType returns the Prometheus value type of the register
+func (r Register) valueType() prometheus.ValueType {
+	if r.Counter {
+		return prometheus.CounterValue
+	}
+	return prometheus.GaugeValue
+}
+
+// Texts of the operation status codes of the D-500 firmware
+var d500StatusCodes = map[int]string{
+	0:  "Genset at rest",
+	5:  "Cranking",
+	8:  "Running off load",
+	13: "Master genset on load",
+	22: "Cooling down",
+}
+
+// Units of the name components that metric names end with, e.g. mains_voltage_v
+var nameUnits = map[string]string{
+	"v": "V", "a": "A", "kw": "kW", "kwh": "kWh", "hz": "Hz", "c": "°C", "f": "°F", "percent": "%",
+	"seconds": "s", "hours": "h", "days": "d", "dbm": "dBm", "watts": "W", "joules": "J",
+	"celsius": "°C", "fahrenheit": "°F", "degrees": "°", "meters": "m",
+}
+
+// Unit returns the unit of the register derived from its name, or "" for
+// states, counts and other dimensionless values
+func (r Register) Unit() string {
+	parts := strings.Split(r.Name, "_")
+	for i := len(parts) - 1; i > 0; i-- {
+		if u, ok := nameUnits[parts[i]]; ok {
+			return u
+		}
+	}
+	return ""
+}
+
+// labelNames returns the variable label names of the register, if any
+func (r Register) labelNames() []string {
+	var names []string
+	for _, l := range r.Labels {
+		names = append(names, l.Name)
+	}
+	if r.Type == String {
+		names = append(names, r.InfoLabel)
+	}
+	return names
+}
+
+// labelValues returns the variable label values of the register, if any
+func (r Register) labelValues() []string {
+	var values []string
+	for _, l := range r.Labels {
+		values = append(values, l.Value)
+	}
+	return values
+}
+
+// bitRegisters expands a bit-field register into one 0/1 register per bit, labeled "1".."n"
+func bitRegisters(name, help string, offset int, labelName string, n int) []Register {
+	regs := make([]Register, n)
+	for i := range regs {
+		regs[i] = Register{Name: name, Help: help, Offset: offset, Mask: 1 << i, Labels: []Label{{labelName, strconv.Itoa(i + 1)}}}
+	}
+	return regs
+}
+
+// AlarmMetric is the register name of the alarm bits, one series per alarm and severity
+const AlarmMetric = "alarm_active"
+
+// alarmRegisters expands an alarm bit-field register into one 0/1 register per alarm, the
+// first on bit 0, labeled with the severity and the alarm. Shutdowns stop the engine at
+// once, load dumps open the genset contactor and stop it after the cooldown, and warnings
+// only raise the alarm.
+func alarmRegisters(offset int, severity string, alarms ...string) []Register {
+	regs := make([]Register, len(alarms))
+	for i, alarm := range alarms {
+		regs[i] = Register{Name: AlarmMetric, Help: "Alarm state (1 = active)", Offset: offset, Mask: 1 << i, Labels: []Label{{"severity", severity}, {"alarm", alarm}}}
+	}
+	return regs
+}
+
+// Alarm bits shared by the D-300, D-500 and D-700: shutdowns, load dumps and warnings
+var (
+	d500ShutdownAlarms = []string{
+		"emergency_stop", "low_oil_pressure", "high_coolant_temp", "low_coolant_level",
+		"overspeed", "underspeed", "low_genset_voltage", "high_genset_voltage",
+		"low_genset_freq", "high_genset_freq", "overcurrent", "reverse_power",
+		"fail_to_start", "fail_to_stop", "charge_alternator_fail", "oil_pressure_sender_open",
+	}
+	d500LoadDumpAlarms = []string{
+		"overcurrent", "excess_power", "reverse_power", "genset_phase_order",
+		"low_fuel_level", "high_coolant_temp",
+	}
+	d500WarningAlarms = []string{
+		"low_battery_voltage", "high_battery_voltage", "low_fuel_level", "high_coolant_temp",
+		"low_oil_pressure", "charge_alternator_fail", "service_request", "mains_phase_order",
+		"unbalanced_current", "fail_to_stop",
+	}
+)
+
+// Alarm bits of the DKG-507 and DKG-509, reported as shutdowns and warnings only
+var (
+	dkgShutdownAlarms = []string{
+		"emergency_stop", "low_oil_pressure", "high_coolant_temp", "overspeed",
+		"underspeed", "low_genset_voltage", "high_genset_voltage", "fail_to_start",
+		"charge_alternator_fail",
+	}
+	dkgWarningAlarms = []string{
+		"low_battery_voltage", "high_battery_voltage", "low_fuel_level", "high_coolant_temp",
+		"service_request", "fail_to_stop",
+	}
+)
+
+// getUint32 handles word swapping for 32-bit values; Datakom D500 uses Low Word First by default
+func getUint32(regs []uint16, offset int, order WordOrder) uint32 {
+	if len(regs) < offset+2 {
+		return 0
+	}
+	if order == HighWordFirst {
+		return uint32(regs[offset])<<16 | uint32(regs[offset+1])
+	}
+	return uint32(regs[offset+1])<<16 | uint32(regs[offset])
+}
+
+// Help of the transfer switch position, decoded from the genset (bit 0) and mains (bit 1) states
+const atsPositionHelp = "Transfer switch position (0 = open, 1 = genset, 2 = mains, 3 = both closed)"
+
+// Control writes shared by the D-300, D-500 and D-700: the button simulation bit-field
+// (Addr: 8193) and the service counter reset (Addr: 8196)
+var d500Commands = map[string]Command{
+	"off":           {Address: 8193, Value: 0x0001, Help: "Switch to OFF mode, stopping the engine"},
+	"run":           {Address: 8193, Value: 0x0002, Help: "Switch to RUN (manual) mode"},
+	"auto":          {Address: 8193, Value: 0x0004, Help: "Switch to AUTO mode"},
+	"start":         {Address: 8193, Value: 0x0010, Help: "Request an engine start"},
+	"stop":          {Address: 8193, Value: 0x0020, Help: "Request an engine stop"},
+	"mute_horn":     {Address: 8193, Value: 0x0040, Help: "Acknowledge alarms and mute the horn"},
+	"reset_alarms":  {Address: 8193, Value: 0x0080, Help: "Reset latched alarms"},
+	"reset_service": {Address: 8196, Value: 0x0001, Help: "Reset the service counters"},
+}
+
+// D500 register map (D-500 and D-500LITE MK2)
+var d500Profile = DeviceProfile{
+	Model:        "d500",
+	Prefix:       "d500",
+	Power:        "genset_power_kw",
+	FuelLevel:    "fuel_percent",
+	ServiceHours: "service_hours_remain",
+	ServiceDays:  "service_days_remain",
+	Latitude:     "gps_latitude_degrees",
+	Longitude:    "gps_longitude_degrees",
+	Altitude:     "gps_altitude_meters",
+	Blocks: []Block{
+		// Block 1: Mains Voltages (Addr: 10240)
+		{Name: "mains_voltage", Address: 10240, Count: 6, Registers: []Register{
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 0, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 2, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 4, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+		}},
+		// Block 2: Mains Currents (Addr: 10264)
+		{Name: "mains_current", Address: 10264, Count: 6, Registers: []Register{
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 0, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "I1"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 2, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "I2"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 4, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "I3"}}},
+		}},
+		// Block 3: Mains and Genset Line-to-Line Voltages (Addr: 10252-10263)
+		{Name: "line_voltage", Address: 10252, Count: 12, Registers: []Register{
+			{Name: "mains_line_voltage_v", Help: "Mains line-to-line voltage", Offset: 0, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L1-L2"}}},
+			{Name: "mains_line_voltage_v", Help: "Mains line-to-line voltage", Offset: 2, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L2-L3"}}},
+			{Name: "mains_line_voltage_v", Help: "Mains line-to-line voltage", Offset: 4, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L3-L1"}}},
+			{Name: "genset_line_voltage_v", Help: "Genset line-to-line voltage", Offset: 6, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L1-L2"}}},
+			{Name: "genset_line_voltage_v", Help: "Genset line-to-line voltage", Offset: 8, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L2-L3"}}},
+			{Name: "genset_line_voltage_v", Help: "Genset line-to-line voltage", Offset: 10, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L3-L1"}}},
+		}},
+		// Block 4: Mains and Genset Neutral Currents (Addr: 10276-10279)
+		{Name: "neutral_current", Address: 10276, Count: 4, Registers: []Register{
+			{Name: "mains_neutral_current_a", Help: "Mains neutral current", Offset: 0, Type: Uint32, Divisor: 10},
+			{Name: "genset_neutral_current_a", Help: "Genset neutral current", Offset: 2, Type: Uint32, Divisor: 10},
+		}},
+		// Block 5: Genset Power, Frequencies and Engine Parameters (Addr: 10294-10363)
+		{Name: "genset_power", Address: 10294, Count: 2, Registers: []Register{
+			{Name: "genset_power_kw", Help: "Total Active Power", Offset: 0, Type: Uint32, Divisor: 10},
+		}},
+		{Name: "phase_power", Address: 10296, Count: 6, Registers: []Register{
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 0, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 2, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 4, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+		}},
+		{Name: "harmonics", Address: 10310, Count: 6, Registers: []Register{
+			{Name: "genset_voltage_thd_percent", Help: "Genset voltage total harmonic distortion", Offset: 0, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "genset_voltage_thd_percent", Help: "Genset voltage total harmonic distortion", Offset: 1, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "genset_voltage_thd_percent", Help: "Genset voltage total harmonic distortion", Offset: 2, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+			{Name: "genset_current_thd_percent", Help: "Genset current total harmonic distortion", Offset: 3, Divisor: 10, Labels: []Label{{"phase", "I1"}}},
+			{Name: "genset_current_thd_percent", Help: "Genset current total harmonic distortion", Offset: 4, Divisor: 10, Labels: []Label{{"phase", "I2"}}},
+			{Name: "genset_current_thd_percent", Help: "Genset current total harmonic distortion", Offset: 5, Divisor: 10, Labels: []Label{{"phase", "I3"}}},
+		}},
+		{Name: "engine", Address: 10338, Count: 26, Registers: []Register{
+			{Name: "mains_freq_hz", Help: "Mains Frequency", Offset: 0, Divisor: 100},
+			{Name: "gen_freq_hz", Help: "Genset Frequency", Offset: 1, Divisor: 100},
+			{Name: "battery_v", Help: "Battery Voltage", Offset: 3, Divisor: 100},
+			{Name: "engine_temp_c", Help: "Coolant Temperature", Offset: 24, Type: Int16, Divisor: 10},
+			{Name: "fuel_percent", Help: "Fuel Level", Offset: 25, Divisor: 10},
+		}},
+		// Block 6: Operation Status, Engine Statistics and Service Counters (Addr: 10604-10636)
+		{Name: "status", Address: 10604, Count: 34, Registers: []Register{
+			{Name: "op_status", Help: "Operational Status", Offset: 0, Divisor: 1, Codes: d500StatusCodes},
+			{Name: "contactor_closed", Help: "Contactor state (1 = closed)", Offset: 1, Mask: 0x0001, Labels: []Label{{"contactor", "genset"}}},
+			{Name: "contactor_closed", Help: "Contactor state (1 = closed)", Offset: 1, Mask: 0x0002, Labels: []Label{{"contactor", "mains"}}},
+			{Name: "ats_position", Help: atsPositionHelp, Offset: 1, Mask: 0x0003, Field: true},
+			{Name: "engine_cranks_total", Help: "Number of engine cranking attempts", Offset: 12, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "engine_starts_total", Help: "Number of successful engine starts", Offset: 14, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "genset_on_load_total", Help: "Number of times the genset took the load", Offset: 16, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "run_hours_total", Help: "Total Engine Run Hours", Offset: 18, Type: Uint32, Divisor: 100},
+			{Name: "total_energy_kwh", Help: "Total Accumulated Energy", Offset: 24, Type: Uint32, Divisor: 10},
+			{Name: "service_hours_remain", Help: "Hours remaining to Maintenance", Offset: 30, Type: Uint32, Divisor: 100},
+			{Name: "service_days_remain", Help: "Days remaining to Maintenance", Offset: 32, Type: Uint32, Divisor: 100},
+		}},
+		// Block 7: Digital Input and Relay Output Status bit-fields (Addr: 10672-10673)
+		{Name: "io", Address: 10672, Count: 2, Registers: append(
+			bitRegisters("digital_input", "Digital input state (1 = active)", 0, "input", 8),
+			bitRegisters("relay_output", "Relay output state (1 = energized)", 1, "output", 6)...,
+		)},
+		// Block 8: Internal GSM Modem of units with the modem option (Addr: 10700-10711)
+		{Name: "gsm", Address: 10700, Count: 12, Disabled: true, Registers: []Register{
+			{Name: "gsm_rssi_dbm", Help: "GSM modem received signal strength", Offset: 0, Type: Int16, Divisor: 1},
+			{Name: "gsm_registration_status", Help: "GSM network registration (0 = not registered, 1 = home, 2 = searching, 3 = denied, 5 = roaming)", Offset: 1, Divisor: 1},
+			{Name: "gsm_data_connected", Help: "GSM packet data session state (1 = connected)", Offset: 2, Mask: 0x0001},
+			{Name: "gsm_operator_info", Help: "GSM network operator", Offset: 4, Type: String, Length: 8, InfoLabel: "operator"},
+		}},
+		// Block 9: Real-Time Clock (Addr: 10560-10565)
+		{Name: "clock", Address: 10560, Count: 6, Registers: []Register{
+			{Name: "clock_offset_seconds", Help: "Controller real-time clock offset from the exporter host clock", Offset: 0, Type: DateTime},
+		}},
+		// Block 10: Event Log Counter (Addr: 11000-11001)
+		{Name: "events", Address: 11000, Count: 2, Registers: []Register{
+			{Name: "event_records_total", Help: "Number of events recorded by the controller", Offset: 0, Type: Uint32, Divisor: 1, Counter: true},
+		}},
+		// Block 11: GPS Position of MK2 units with the GPS option (Addr: 10720-10725)
+		{Name: "gps", Address: 10720, Count: 6, Disabled: true, Registers: []Register{
+			{Name: "gps_latitude_degrees", Help: "GPS latitude, north positive", Offset: 0, Type: Int32, Divisor: 1e6},
+			{Name: "gps_longitude_degrees", Help: "GPS longitude, east positive", Offset: 2, Type: Int32, Divisor: 1e6},
+			{Name: "gps_altitude_meters", Help: "GPS altitude above sea level", Offset: 4, Type: Int16, Divisor: 1},
+			{Name: "gps_satellites", Help: "Number of GPS satellites in view", Offset: 5, Divisor: 1},
+		}},
+		// Block 12: Shutdown, Load Dump and Warning alarm bit-fields (Addr: 10520-10522)
+		{Name: "alarms", Address: 10520, Count: 3, Registers: slices.Concat(
+			alarmRegisters(0, "shutdown", d500ShutdownAlarms...),
+			alarmRegisters(1, "loaddump", d500LoadDumpAlarms...),
+			alarmRegisters(2, "warning", d500WarningAlarms...),
+		)},
+	},
+	// Spare analog senders (Addr: 10364-10367)
+	AnalogInputs: AnalogInputs{Address: 10364, Count: 4},
+	// Button simulation and service counter reset (Addr: 8193, 8196)
+	Commands: d500Commands,
+	// Event records, 16 registers each (Addr: 11008-12607)
+	EventLog: EventLog{CountAddress: 11000, Address: 11008, Capacity: 100},
+	// Product code (Addr: 10000)
+	Identity: Identity{Address: 10000, Code: 500},
+}
+
+// D700 register map, shifted relative to the D500, using high-word-first 32-bit values
+// and extended with breaker states
+var d700Profile = DeviceProfile{
+	Model:        "d700",
+	Prefix:       "d700",
+	Power:        "genset_power_kw",
+	FuelLevel:    "fuel_percent",
+	ServiceHours: "service_hours_remain",
+	ServiceDays:  "service_days_remain",
+	Blocks: []Block{
+		// Block 1: Mains Voltages (Addr: 10240)
+		{Name: "mains_voltage", Address: 10240, Count: 6, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 0, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 2, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 4, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+		}},
+		// Block 2: Mains Currents (Addr: 10258), reported with two decimals
+		{Name: "mains_current", Address: 10258, Count: 6, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 0, Type: Uint32, Divisor: 100, Labels: []Label{{"phase", "I1"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 2, Type: Uint32, Divisor: 100, Labels: []Label{{"phase", "I2"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 4, Type: Uint32, Divisor: 100, Labels: []Label{{"phase", "I3"}}},
+		}},
+		// Block 3: Engine Parameters and Frequency (Addr: 10304-10365)
+		{Name: "genset_power", Address: 10304, Count: 2, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "genset_power_kw", Help: "Total Active Power", Offset: 0, Type: Uint32, Divisor: 10},
+		}},
+		{Name: "phase_power", Address: 10306, Count: 6, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 0, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 2, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "genset_phase_power_kw", Help: "Genset phase active power", Offset: 4, Type: Int32, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+		}},
+		{Name: "engine", Address: 10340, Count: 26, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "gen_freq_hz", Help: "Genset Frequency", Offset: 0, Divisor: 100},
+			{Name: "battery_v", Help: "Battery Voltage", Offset: 2, Divisor: 100},
+			{Name: "engine_temp_c", Help: "Coolant Temperature", Offset: 24, Type: Int16, Divisor: 10},
+			{Name: "fuel_percent", Help: "Fuel Level", Offset: 25, Divisor: 10},
+		}},
+		// Block 4: Operation Status, Breakers and Service Counters (Addr: 10604-10639)
+		{Name: "status", Address: 10604, Count: 36, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "op_status", Help: "Operational Status", Offset: 0, Divisor: 1},
+			{Name: "breaker_closed", Help: "Circuit breaker state (1 = closed)", Offset: 1, Mask: 0x0001, Labels: []Label{{"breaker", "genset"}}},
+			{Name: "breaker_closed", Help: "Circuit breaker state (1 = closed)", Offset: 1, Mask: 0x0002, Labels: []Label{{"breaker", "mains"}}},
+			{Name: "ats_position", Help: atsPositionHelp, Offset: 1, Mask: 0x0003, Field: true},
+			{Name: "run_hours_total", Help: "Total Engine Run Hours", Offset: 20, Type: Uint32, Divisor: 100},
+			{Name: "total_energy_kwh", Help: "Total Accumulated Energy", Offset: 26, Type: Uint32, Divisor: 10},
+			{Name: "service_hours_remain", Help: "Hours remaining to Maintenance", Offset: 32, Type: Uint32, Divisor: 100},
+			{Name: "service_days_remain", Help: "Days remaining to Maintenance", Offset: 34, Type: Uint32, Divisor: 100},
+		}},
+		// Block 5: Synchronization and Load Sharing of paralleled gensets (Addr: 10400-10405)
+		{Name: "sync", Address: 10400, Count: 6, WordOrder: HighWordFirst, Registers: []Register{
+			{Name: "bus_voltage_v", Help: "Busbar phase voltage", Offset: 0, Type: Uint32, Divisor: 10},
+			{Name: "bus_freq_hz", Help: "Busbar frequency", Offset: 2, Divisor: 100},
+			{Name: "sync_phase_angle_degrees", Help: "Phase angle between genset and busbar voltages", Offset: 3, Type: Int16, Divisor: 10},
+			{Name: "sync_voltage_diff_v", Help: "Voltage difference between genset and busbar", Offset: 4, Type: Int16, Divisor: 10},
+			{Name: "load_share_percent", Help: "Share of the total load of the paralleled gensets carried by this genset", Offset: 5, Divisor: 10},
+		}},
+		// Block 6: Shutdown, Load Dump and Warning alarm bit-fields (Addr: 10520-10522), with
+		// the synchronization failure of paralleled gensets as a further load dump
+		{Name: "alarms", Address: 10520, Count: 3, Registers: slices.Concat(
+			alarmRegisters(0, "shutdown", d500ShutdownAlarms...),
+			alarmRegisters(1, "loaddump", append(slices.Clone(d500LoadDumpAlarms), "sync_fail")...),
+			alarmRegisters(2, "warning", d500WarningAlarms...),
+		)},
+	},
+	// Button simulation and service counter reset (Addr: 8193, 8196)
+	Commands: d500Commands,
+	// Product code (Addr: 10000)
+	Identity: Identity{Address: 10000, Code: 700},
+}
+
+// D300 register map, a reduced D500 layout without mains current measurement
+var d300Profile = DeviceProfile{
+	Model:        "d300",
+	Prefix:       "d300",
+	Power:        "genset_power_kw",
+	FuelLevel:    "fuel_percent",
+	ServiceHours: "service_hours_remain",
+	Blocks: []Block{
+		// Block 1: Mains Voltages (Addr: 10240)
+		{Name: "mains_voltage", Address: 10240, Count: 6, Registers: []Register{
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 0, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L1"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 2, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L2"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 4, Type: Uint32, Divisor: 10, Labels: []Label{{"phase", "L3"}}},
+		}},
+		// Block 2: Genset Power, Frequencies and Engine Parameters (Addr: 10294-10363)
+		{Name: "genset_power", Address: 10294, Count: 2, Registers: []Register{
+			{Name: "genset_power_kw", Help: "Total Active Power", Offset: 0, Type: Uint32, Divisor: 10},
+		}},
+		{Name: "engine", Address: 10338, Count: 26, Registers: []Register{
+			{Name: "mains_freq_hz", Help: "Mains Frequency", Offset: 0, Divisor: 100},
+			{Name: "gen_freq_hz", Help: "Genset Frequency", Offset: 1, Divisor: 100},
+			{Name: "battery_v", Help: "Battery Voltage", Offset: 3, Divisor: 100},
+			{Name: "engine_temp_c", Help: "Coolant Temperature", Offset: 24, Type: Int16, Divisor: 10},
+			{Name: "fuel_percent", Help: "Fuel Level", Offset: 25, Divisor: 10},
+		}},
+		// Block 3: Operation Status, Engine Statistics and Service Counters (Addr: 10604-10635)
+		{Name: "status", Address: 10604, Count: 32, Registers: []Register{
+			{Name: "op_status", Help: "Operational Status", Offset: 0, Divisor: 1, Codes: d500StatusCodes},
+			{Name: "contactor_closed", Help: "Contactor state (1 = closed)", Offset: 1, Mask: 0x0001, Labels: []Label{{"contactor", "genset"}}},
+			{Name: "contactor_closed", Help: "Contactor state (1 = closed)", Offset: 1, Mask: 0x0002, Labels: []Label{{"contactor", "mains"}}},
+			{Name: "ats_position", Help: atsPositionHelp, Offset: 1, Mask: 0x0003, Field: true},
+			{Name: "engine_cranks_total", Help: "Number of engine cranking attempts", Offset: 12, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "engine_starts_total", Help: "Number of successful engine starts", Offset: 14, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "genset_on_load_total", Help: "Number of times the genset took the load", Offset: 16, Type: Uint32, Divisor: 1, Counter: true},
+			{Name: "run_hours_total", Help: "Total Engine Run Hours", Offset: 18, Type: Uint32, Divisor: 100},
+			{Name: "total_energy_kwh", Help: "Total Accumulated Energy", Offset: 24, Type: Uint32, Divisor: 10},
+			{Name: "service_hours_remain", Help: "Hours remaining to Maintenance", Offset: 30, Type: Uint32, Divisor: 100},
+		}},
+		// Block 4: Shutdown, Load Dump and Warning alarm bit-fields (Addr: 10520-10522)
+		{Name: "alarms", Address: 10520, Count: 3, Registers: slices.Concat(
+			alarmRegisters(0, "shutdown", d500ShutdownAlarms...),
+			alarmRegisters(1, "loaddump", d500LoadDumpAlarms...),
+			alarmRegisters(2, "warning", d500WarningAlarms...),
+		)},
+	},
+	// Button simulation and service counter reset (Addr: 8193, 8196)
+	Commands: d500Commands,
+	// Product code (Addr: 10000)
+	Identity: Identity{Address: 10000, Code: 300},
+}
+
+// DKG-507 register map: legacy 16-bit layout starting at address 0
+var dkg507Profile = DeviceProfile{
+	Model:     "dkg507",
+	Prefix:    "dkg507",
+	Power:     "genset_power_kw",
+	FuelLevel: "fuel_percent",
+	Blocks: []Block{
+		// Block 1: Mains Voltages (Addr: 0-2)
+		{Name: "mains_voltage", Address: 0, Count: 3, Registers: []Register{
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 0, Divisor: 1, Labels: []Label{{"phase", "L1"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 1, Divisor: 1, Labels: []Label{{"phase", "L2"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 2, Divisor: 1, Labels: []Label{{"phase", "L3"}}},
+		}},
+		// Block 2: Genset Power and Engine Parameters (Addr: 12-27)
+		{Name: "engine", Address: 12, Count: 16, Registers: []Register{
+			{Name: "genset_power_kw", Help: "Total Active Power", Offset: 0, Divisor: 10},
+			{Name: "gen_freq_hz", Help: "Genset Frequency", Offset: 8, Divisor: 10},
+			{Name: "battery_v", Help: "Battery Voltage", Offset: 9, Divisor: 10},
+			{Name: "engine_temp_c", Help: "Coolant Temperature", Offset: 12, Type: Int16, Divisor: 1},
+			{Name: "fuel_percent", Help: "Fuel Level", Offset: 14, Divisor: 1},
+		}},
+		// Block 3: Operation Status and Run Hours (Addr: 40-43)
+		{Name: "status", Address: 40, Count: 4, Registers: []Register{
+			{Name: "op_status", Help: "Operational Status", Offset: 0, Divisor: 1},
+			{Name: "run_hours_total", Help: "Total Engine Run Hours", Offset: 2, Divisor: 1},
+		}},
+		// Block 4: Shutdown and Warning alarm bit-fields (Addr: 30-31)
+		{Name: "alarms", Address: 30, Count: 2, Registers: append(
+			alarmRegisters(0, "shutdown", dkgShutdownAlarms...),
+			alarmRegisters(1, "warning", dkgWarningAlarms...)...,
+		)},
+	},
+	// Product code (Addr: 100)
+	Identity: Identity{Address: 100, Code: 507},
+}
+
+// DKG-509 register map: the DKG-507 layout extended with mains currents and service counters
+var dkg509Profile = DeviceProfile{
+	Model:        "dkg509",
+	Prefix:       "dkg509",
+	Power:        "genset_power_kw",
+	FuelLevel:    "fuel_percent",
+	ServiceHours: "service_hours_remain",
+	ServiceDays:  "service_days_remain",
+	Blocks: []Block{
+		// Block 1: Mains Voltages and Currents (Addr: 0-5)
+		{Name: "mains_voltage", Address: 0, Count: 3, Registers: []Register{
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 0, Divisor: 1, Labels: []Label{{"phase", "L1"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 1, Divisor: 1, Labels: []Label{{"phase", "L2"}}},
+			{Name: "mains_voltage_v", Help: "Mains phase voltage", Offset: 2, Divisor: 1, Labels: []Label{{"phase", "L3"}}},
+		}},
+		{Name: "mains_current", Address: 3, Count: 3, Registers: []Register{
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 0, Divisor: 10, Labels: []Label{{"phase", "I1"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 1, Divisor: 10, Labels: []Label{{"phase", "I2"}}},
+			{Name: "mains_current_a", Help: "Mains phase current", Offset: 2, Divisor: 10, Labels: []Label{{"phase", "I3"}}},
+		}},
+		// Block 2: Genset Power and Engine Parameters (Addr: 12-27)
+		{Name: "engine", Address: 12, Count: 16, Registers: []Register{
+			{Name: "genset_power_kw", Help: "Total Active Power", Offset: 0, Divisor: 10},
+			{Name: "gen_freq_hz", Help: "Genset Frequency", Offset: 8, Divisor: 10},
+			{Name: "battery_v", Help: "Battery Voltage", Offset: 9, Divisor: 10},
+			{Name: "engine_temp_c", Help: "Coolant Temperature", Offset: 12, Type: Int16, Divisor: 1},
+			{Name: "fuel_percent", Help: "Fuel Level", Offset: 14, Divisor: 1},
+		}},
+		// Block 3: Operation Status, Counters and Service (Addr: 40-49)
+		{Name: "status", Address: 40, Count: 10, Registers: []Register{
+			{Name: "op_status", Help: "Operational Status", Offset: 0, Divisor: 1},
+			{Name: "run_hours_total", Help: "Total Engine Run Hours", Offset: 2, Divisor: 1},
+			{Name: "total_energy_kwh", Help: "Total Accumulated Energy", Offset: 4, Type: Uint32, Divisor: 1},
+			{Name: "service_hours_remain", Help: "Hours remaining to Maintenance", Offset: 8, Divisor: 1},
+			{Name: "service_days_remain", Help: "Days remaining to Maintenance", Offset: 9, Divisor: 1},
+		}},
+		// Block 4: Shutdown and Warning alarm bit-fields (Addr: 30-31)
+		{Name: "alarms", Address: 30, Count: 2, Registers: append(
+			alarmRegisters(0, "shutdown", dkgShutdownAlarms...),
+			alarmRegisters(1, "warning", dkgWarningAlarms...)...,
+		)},
+	},
+	// Product code (Addr: 100)
+	Identity: Identity{Address: 100, Code: 509},
+}
+
+// profiles lists the supported controller models
+var profiles = map[string]*DeviceProfile{
+	d300Profile.Model:   &d300Profile,
+	d500Profile.Model:   &d500Profile,
+	d700Profile.Model:   &d700Profile,
+	dkg507Profile.Model: &dkg507Profile,
+	dkg509Profile.Model: &dkg509Profile,
+}
+
+// Lookup returns the register map for the given model name
+func Lookup(model string) (*DeviceProfile, error) {
+	if p, ok := profiles[model]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unsupported device model %q", model)
+}
+
+// Identify matches the product code registers of the connected controller against the known
+// profiles, returning nil if none matches
+func Identify(client Client) *DeviceProfile {
+	codes := make(map[uint16]uint16)
+	for _, model := range slices.Sorted(maps.Keys(profiles)) {
+		id := profiles[model].Identity
+		if id.Code == 0 {
+			continue
+		}
+		code, ok := codes[id.Address]
+		if !ok {
+			code, _ = client.ReadRegister(id.Address, modbus.HOLDING_REGISTER)
+			codes[id.Address] = code
+		}
+		if code == id.Code {
+			return profiles[model]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package datakom
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGetUint32(t *testing.T) {
+	tests := []struct {
+		name   string
+		regs   []uint16
+		offset int
+		order  WordOrder
+		want   uint32
+	}{
+		{"low word first by default", []uint16{0x5678, 0x1234}, 0, "", 0x12345678},
+		{"low word first", []uint16{0x5678, 0x1234}, 0, LowWordFirst, 0x12345678},
+		{"high word first", []uint16{0x1234, 0x5678}, 0, HighWordFirst, 0x12345678},
+		{"at an offset", []uint16{0xffff, 0x0001, 0x0002}, 1, HighWordFirst, 0x00010002},
+		{"truncated", []uint16{0x1234}, 0, LowWordFirst, 0},
+		{"offset past the end", []uint16{0x1234, 0x5678}, 1, LowWordFirst, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getUint32(tt.regs, tt.offset, tt.order); got != tt.want {
+				t.Errorf("getUint32(%04x, %d, %q) = %#x, want %#x", tt.regs, tt.offset, tt.order, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterValue(t *testing.T) {
+	pi := math.Float32bits(3.14159)
+	tests := []struct {
+		name  string
+		reg   Register
+		regs  []uint16
+		order WordOrder
+		want  float64
+	}{
+		{"uint16 with divisor", Register{Divisor: 10}, []uint16{2305}, "", 230.5},
+		{"uint16 with shift", Register{Divisor: 1, Shift: -40}, []uint16{122}, "", 82},
+		{"int16 negative", Register{Type: Int16, Divisor: 10}, []uint16{0xffce}, "", -5},
+		{"uint32 low word first", Register{Type: Uint32, Divisor: 1}, []uint16{0x86a0, 0x0001}, LowWordFirst, 100000},
+		{"uint32 high word first", Register{Type: Uint32, Divisor: 1}, []uint16{0x0001, 0x86a0}, HighWordFirst, 100000},
+		{"int32 negative", Register{Type: Int32, Divisor: 1e6}, []uint16{0x0000, 0xff00}, LowWordFirst, -16.777216},
+		{"float32", Register{Type: Float32, Divisor: 1}, []uint16{uint16(pi), uint16(pi >> 16)}, LowWordFirst, float64(float32(3.14159))},
+		{"at an offset", Register{Offset: 2, Divisor: 1}, []uint16{1, 2, 3}, "", 3},
+		{"offset past the end", Register{Offset: 3, Divisor: 1}, []uint16{1, 2, 3}, "", 0},
+		{"bit set", Register{Mask: 0x0004, Divisor: 1}, []uint16{0x0006}, "", 1},
+		{"bit clear", Register{Mask: 0x0008, Divisor: 1}, []uint16{0x0006}, "", 0},
+		{"bit field", Register{Mask: 0x00f0, Field: true, Divisor: 1}, []uint16{0x0a5f}, "", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reg.value(tt.regs, tt.order); got != tt.want {
+				t.Errorf("value(%04x) = %g, want %g", tt.regs, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package datakom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sample is a single decoded value of a reading
+type Sample struct {
+	Name   string            `json:"name"` // Metric name including the model prefix
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit,omitempty"`
+
+	help        string
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	labelValues []string
+}
+
+// Reading is the result of one poll of a target
+type Reading struct {
+	Target  string            `json:"target"`
+	Model   string            `json:"model"`
+	Labels  map[string]string `json:"labels,omitempty"` // Constant labels of the target
+	Time    time.Time         `json:"time"`
+	Samples []Sample          `json:"samples"`
+	Error   string            `json:"error,omitempty"` // Set if the controller could not be reached
+}
+
+// Sink receives every reading polled in the background
+type Sink interface {
+	Publish(r *Reading)
+}
+
+// Metric converts the sample into a Prometheus constant metric
+func (s Sample) Metric() prometheus.Metric {
+	return prometheus.MustNewConstMetric(s.desc, s.valueType, s.Value, s.labelValues...)
+}
+
+// Help returns the help text of the metric
+func (s Sample) Help() string {
+	return s.help
+}
+
+// Counter reports whether the metric is a counter rather than a gauge
+func (s Sample) Counter() bool {
+	return s.valueType == prometheus.CounterValue
+}
+
+// LabelValues returns the values of the variable labels in the order of the metric descriptor
+func (s Sample) LabelValues() []string {
+	return s.labelValues
+}
@@ -0,0 +1,78 @@
+package datakom
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simonvetter/modbus"
+)
+
+const serviceDueHelp = "Whether maintenance is due (1 = due)"
+
+// ServiceConfig sets when maintenance is due: once the remaining service hours or days
+// reach their thresholds, or while the maintenance alarm bits of a register are set
+type ServiceConfig struct {
+	Hours    float64 `yaml:"hours"`    // Remaining hours at which service is due, defaults to 0
+	Days     float64 `yaml:"days"`     // Remaining days at which service is due, defaults to 0
+	Register uint16  `yaml:"register"` // Register holding the maintenance alarm bits, instead of the thresholds
+	Mask     uint16  `yaml:"mask"`     // Maintenance alarm bits of the register, defaults to all
+}
+
+// Validate checks the thresholds
+func (s ServiceConfig) Validate() error {
+	if s.Hours < 0 || s.Days < 0 {
+		return fmt.Errorf("hours and days must not be negative")
+	}
+	if s.Register == 0 && s.Mask != 0 {
+		return fmt.Errorf("mask requires register")
+	}
+	return nil
+}
+
+// serviceSample derives the service due state from the maintenance alarm register, or from
+// the remaining service counter samples if they were read. It must be called within a session.
+func (c *Collector) serviceSample(samples []Sample) (Sample, bool) {
+	due, ok := false, false
+	if c.Service.Register != 0 {
+		regs, err := c.ReadRegisters("service", c.Service.Register, 1, modbus.HOLDING_REGISTER)
+		if err != nil || len(regs) < 1 {
+			log.Printf("Failed to read maintenance alarms from %s: %v", c.name, err)
+			return Sample{}, false
+		}
+		mask := c.Service.Mask
+		if mask == 0 {
+			mask = 0xFFFF
+		}
+		due, ok = regs[0]&mask != 0, true
+	} else {
+		hours := c.profile.Prefix + "_" + c.profile.ServiceHours
+		days := c.profile.Prefix + "_" + c.profile.ServiceDays
+		for _, s := range samples {
+			switch {
+			case c.profile.ServiceHours != "" && s.Name == hours:
+				remain := s.Value
+				if s.Unit == "s" {
+					remain /= 3600
+				}
+				due, ok = due || remain <= c.Service.Hours, true
+			case c.profile.ServiceDays != "" && s.Name == days:
+				due, ok = due || s.Value <= c.Service.Days, true
+			}
+		}
+	}
+	if !ok {
+		return Sample{}, false
+	}
+
+	s := Sample{
+		Name:      c.profile.Prefix + "_service_due",
+		help:      serviceDueHelp,
+		desc:      c.serviceDesc,
+		valueType: prometheus.GaugeValue,
+	}
+	if due {
+		s.Value = 1
+	}
+	return s, true
+}
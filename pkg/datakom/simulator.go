@@ -0,0 +1,254 @@
+package datakom
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+// Number of records in the simulated event log, one per hour before the start
+const simulatedEvents = 12
+
+// Texts of the simulated string registers
+var simulatedTexts = map[string]string{
+	"gsm_operator_info": "Kyivstar",
+}
+
+// Simulator serves the register map of a device profile over Modbus TCP with realistic,
+// slowly varying values, for demos and integration tests without a controller
+type Simulator struct {
+	profile *DeviceProfile
+	start   time.Time
+
+	mu      sync.Mutex
+	written map[uint16]uint16 // Registers written by clients, overriding the simulated values
+}
+
+// NewSimulator returns a simulator of the profile, starting now. It implements
+// modbus.RequestHandler, to be served with modbus.NewServer.
+func NewSimulator(profile *DeviceProfile) *Simulator {
+	return &Simulator{profile: profile, start: time.Now(), written: make(map[uint16]uint16)}
+}
+
+// value returns the simulated value of a register after running for the given time
+func (s *Simulator) value(r Register, t time.Duration) float64 {
+	// Sine waves with periods of minutes, shifted per register (e.g. per phase)
+	wave := func(period time.Duration) float64 {
+		return math.Sin(2*math.Pi*t.Seconds()/period.Seconds() + float64(r.Offset))
+	}
+	label := ""
+	if len(r.Labels) > 0 {
+		label = r.Labels[0].Value
+	}
+	h := t.Hours()
+
+	switch r.Name {
+	case "mains_voltage_v":
+		return 230 + 3*wave(10*time.Minute)
+	case "mains_current_a":
+		return 35 + 8*wave(15*time.Minute)
+	case "mains_line_voltage_v", "genset_line_voltage_v":
+		return 398 + 5*wave(10*time.Minute)
+	case "mains_neutral_current_a", "genset_neutral_current_a":
+		return 2.5 + wave(15*time.Minute)
+	case "genset_power_kw":
+		return 25 + 5*wave(15*time.Minute)
+	case "genset_phase_power_kw":
+		return 8.3 + 2*wave(15*time.Minute)
+	case "genset_voltage_thd_percent":
+		return 2.5 + 0.5*wave(10*time.Minute)
+	case "genset_current_thd_percent":
+		return 8 + 2*wave(10*time.Minute)
+	case "bus_voltage_v":
+		return 230 + 2*wave(10*time.Minute)
+	case "bus_freq_hz":
+		return 50 + 0.03*wave(time.Minute)
+	case "sync_phase_angle_degrees":
+		return 3 * wave(time.Minute)
+	case "sync_voltage_diff_v":
+		return 1.5 * wave(5*time.Minute)
+	case "load_share_percent":
+		return 50 + 5*wave(15*time.Minute)
+	case "gen_freq_hz":
+		return 50 + 0.05*wave(time.Minute)
+	case "mains_freq_hz":
+		return 50 + 0.02*wave(3*time.Minute)
+	case "battery_v":
+		return 27.2 + 0.2*wave(30*time.Minute)
+	case "engine_temp_c":
+		return 82 + 4*wave(20*time.Minute)
+	case "fuel_percent":
+		return max(5, 80-2*h)
+	case "op_status":
+		return 13 // Master genset on load
+	case "run_hours_total":
+		return 1520 + h
+	case "engine_cranks_total":
+		return 1342
+	case "engine_starts_total":
+		return 1297
+	case "genset_on_load_total":
+		return 1184
+	case "total_energy_kwh":
+		return 48000 + 25*h
+	case "service_hours_remain":
+		return max(0, 250-h)
+	case "service_days_remain":
+		return 90
+	case "gsm_rssi_dbm":
+		return -71 + 3*wave(5*time.Minute)
+	case "gsm_registration_status", "gsm_data_connected":
+		return 1
+	case "gps_latitude_degrees":
+		return 50.4501 + 0.0001*wave(30*time.Minute)
+	case "gps_longitude_degrees":
+		return 30.5234 + 0.0001*wave(30*time.Minute)
+	case "gps_altitude_meters":
+		return 179
+	case "gps_satellites":
+		return 9
+	case "event_records_total":
+		return simulatedEvents
+	case "digital_input":
+		return b2f(label == "1")
+	case "relay_output":
+		return b2f(label == "1" || label == "2")
+	case "breaker_closed", "contactor_closed":
+		return b2f(label == "genset")
+	case "ats_position":
+		return 1 // Genset on load
+	}
+	return 0
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// encode returns the raw register words holding the value, the inverse of Register.value
+func encode(r Register, v float64, order WordOrder, now time.Time) []uint16 {
+	switch r.Type {
+	case String:
+		words := make([]uint16, r.Length)
+		text := simulatedTexts[r.Name]
+		for i := 0; i < 2*r.Length && i < len(text); i++ {
+			words[i/2] |= uint16(text[i]) << (8 * (1 - i%2))
+		}
+		return words
+	case DateTime:
+		loc := r.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		now = now.In(loc)
+		return []uint16{uint16(now.Year()), uint16(now.Month()), uint16(now.Day()), uint16(now.Hour()), uint16(now.Minute()), uint16(now.Second())}
+	}
+
+	v -= r.Shift
+	if r.Divisor != 0 {
+		v *= r.Divisor
+	}
+	var raw uint32
+	switch r.Type {
+	case Int16:
+		raw = uint32(uint16(int16(math.Round(v))))
+	case Int32:
+		raw = uint32(int32(math.Round(v)))
+	case Float32:
+		raw = math.Float32bits(float32(v))
+	default:
+		raw = uint32(math.Round(max(v, 0)))
+	}
+	if r.Type.words() == 1 {
+		return []uint16{uint16(raw)}
+	}
+	if order == HighWordFirst {
+		return []uint16{uint16(raw >> 16), uint16(raw)}
+	}
+	return []uint16{uint16(raw), uint16(raw >> 16)}
+}
+
+// image returns the simulated contents of all registers of the profile at the given time
+func (s *Simulator) image(now time.Time) map[uint16]uint16 {
+	t := now.Sub(s.start)
+	regs := make(map[uint16]uint16)
+	for _, b := range s.profile.Blocks {
+		for _, r := range b.Registers {
+			v := s.value(r, t)
+			if r.Mask != 0 {
+				if r.Field {
+					regs[b.Address+uint16(r.Offset)] |= uint16(v) << bits.TrailingZeros16(r.Mask) & r.Mask
+				} else if v != 0 {
+					regs[b.Address+uint16(r.Offset)] |= r.Mask
+				}
+				continue
+			}
+			for i, w := range encode(r, v, b.WordOrder, now) {
+				regs[b.Address+uint16(r.Offset+i)] = w
+			}
+		}
+	}
+
+	if id := s.profile.Identity; id.Code != 0 {
+		regs[id.Address] = id.Code
+	}
+	if l := s.profile.EventLog; l.Capacity > 0 {
+		regs[l.CountAddress], regs[l.CountAddress+1] = simulatedEvents, 0
+		for n := 0; n < simulatedEvents; n++ {
+			at := s.start.Add(time.Duration(n-simulatedEvents) * time.Hour).In(time.Local)
+			runHours := uint32(1520+n-simulatedEvents) * 100
+			record := []uint16{
+				uint16(1 + n%3), 13,
+				uint16(at.Year()), uint16(at.Month()), uint16(at.Day()), uint16(at.Hour()), uint16(at.Minute()), uint16(at.Second()),
+				uint16(runHours), uint16(runHours >> 16), 2710, 820, 640,
+			}
+			for i, w := range record {
+				regs[l.Address+uint16(n%l.Capacity*eventRecordSize+i)] = w
+			}
+		}
+	}
+	return regs
+}
+
+// HandleHoldingRegisters serves the simulated registers; written values override them
+func (s *Simulator) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.IsWrite {
+		for i, v := range req.Args {
+			s.written[req.Addr+uint16(i)] = v
+		}
+		return nil, nil
+	}
+	regs := s.image(time.Now())
+	out := make([]uint16, req.Quantity)
+	for i := range out {
+		addr := req.Addr + uint16(i)
+		if v, ok := s.written[addr]; ok {
+			out[i] = v
+		} else {
+			out[i] = regs[addr]
+		}
+	}
+	return out, nil
+}
+
+// HandleInputRegisters serves zeros, as the controllers map everything to holding registers
+func (s *Simulator) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	return make([]uint16, req.Quantity), nil
+}
+
+func (s *Simulator) HandleCoils(*modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleDiscreteInputs(*modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
@@ -0,0 +1,121 @@
+package datakom
+
+import (
+	"maps"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+// serve serves the Modbus handler on a free local port and returns a client of it
+func serve(t *testing.T, handler modbus.RequestHandler) *modbus.ModbusClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{URL: "tcp://" + addr, Timeout: 5 * time.Second, MaxClients: 1}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{URL: "tcp://" + addr, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// serveSimulator serves a simulator of the profile and returns a collector connected to it
+func serveSimulator(t *testing.T, profile *DeviceProfile) (*Collector, *Simulator) {
+	t.Helper()
+	sim := NewSimulator(profile)
+	return NewCollector(serve(t, sim), "sim", profile), sim
+}
+
+func TestSimulatorRoundTrip(t *testing.T) {
+	for _, model := range slices.Sorted(maps.Keys(profiles)) {
+		t.Run(model, func(t *testing.T) {
+			profile, err := Lookup(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// With the optional blocks enabled, which the simulator serves as well
+			enabled := true
+			var enable []BlockConfig
+			for _, b := range profile.Blocks {
+				if b.Disabled {
+					enable = append(enable, BlockConfig{Name: b.Name, Enabled: &enabled})
+				}
+			}
+			if profile, err = profile.Configure(enable, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			c, sim := serveSimulator(t, profile)
+			reading, err := c.Poll()
+			if err != nil {
+				t.Fatalf("Poll: %v", err)
+			}
+
+			samples := make(map[string]Sample)
+			for _, s := range reading.Samples {
+				samples[s.Name+"{"+strings.Join(s.labelValues, ",")+"}"] = s
+			}
+			for _, b := range profile.Blocks {
+				if s := samples[profile.Prefix+"_block_read_success{"+b.Name+"}"]; s.Value != 1 {
+					t.Errorf("block %s: read failed", b.Name)
+				}
+			}
+
+			at := reading.Time.Sub(sim.start)
+			for _, b := range profile.Blocks {
+				for _, r := range b.Registers {
+					name := profile.Prefix + "_" + r.Name
+					want := sim.value(r, at)
+					switch {
+					case r.Type == String:
+						key := name + "{" + strings.Join(append(r.labelValues(), simulatedTexts[r.Name]), ",") + "}"
+						if _, ok := samples[key]; !ok {
+							t.Errorf("%s: no sample %s", r.Name, key)
+						}
+						continue
+					case r.Type == DateTime:
+						want = 0 // Clock offset of the simulated clock
+					case r.Mask != 0 && !r.Field:
+						want = b2f(want != 0)
+					}
+
+					key := name + "{" + strings.Join(r.labelValues(), ",") + "}"
+					s, ok := samples[key]
+					if !ok {
+						t.Errorf("%s: no sample %s", r.Name, key)
+						continue
+					}
+					// Within the resolution of the register, or a second of the clock
+					tolerance := 1 / divisor(r)
+					switch r.Type {
+					case Float32:
+						tolerance = 1e-6 * math.Abs(want)
+					case DateTime:
+						tolerance = 1
+					}
+					if math.Abs(s.Value-want) > tolerance {
+						t.Errorf("%s: got %g, want %g", key, s.Value, want)
+					}
+				}
+			}
+		})
+	}
+}
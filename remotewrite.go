@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSink pushes every reading to a Prometheus remote-write endpoint. Readings
+// that could not be sent, e.g. while a cellular link is down, are kept up to a limit
+// and sent along with the next one. Pushes are made by a goroutine of their own, so a
+// slow link never holds up the polls of the targets.
+type remoteWriteSink struct {
+	cfg    RemoteWriteConfig
+	client *http.Client
+	wake   chan struct{} // Signals readings to send
+
+	mu      sync.Mutex
+	pending []*datakom.Reading
+}
+
+// validate checks the settings and applies their defaults
+func (cfg *RemoteWriteConfig) validate() error {
+	if cfg.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if cfg.BearerToken != "" && cfg.Username != "" {
+		return fmt.Errorf("bearer_token and username are mutually exclusive")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.MaxPending == 0 {
+		cfg.MaxPending = 100
+	}
+	return nil
+}
+
+// newRemoteWriteSink validates the configuration and starts sending the readings published
+func newRemoteWriteSink(cfg RemoteWriteConfig) (*remoteWriteSink, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &remoteWriteSink{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}, wake: make(chan struct{}, 1)}
+	go s.run()
+	return s, nil
+}
+
+// Publish queues the reading to be sent along with any pending ones
+func (s *remoteWriteSink) Publish(r *datakom.Reading) {
+	s.mu.Lock()
+	s.pending = append(s.pending, r)
+	if n := len(s.pending) - s.cfg.MaxPending; n > 0 {
+		log.Printf("Remote write backlog full, dropping %d readings", n)
+		s.pending = slices.Delete(s.pending, 0, n)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // A send is already due, and takes this reading along
+	}
+}
+
+// run sends the pending readings whenever new ones arrive. Sent readings leave the
+// backlog; those that failed are retried with the next reading.
+func (s *remoteWriteSink) run() {
+	for range s.wake {
+		s.mu.Lock()
+		batch := slices.Clone(s.pending)
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.send(batch); err != nil {
+			log.Printf("Failed to remote write %d readings, keeping them for the next attempt: %v", len(batch), err)
+			continue
+		}
+
+		sent := make(map[*datakom.Reading]bool, len(batch))
+		for _, r := range batch {
+			sent[r] = true
+		}
+		s.mu.Lock()
+		s.pending = slices.DeleteFunc(s.pending, func(r *datakom.Reading) bool { return sent[r] })
+		s.mu.Unlock()
+	}
+}
+
+// send pushes the readings in a single write request
+func (s *remoteWriteSink) send(readings []*datakom.Reading) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(readings))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "datakom-exporter")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.BearerToken)
+	} else if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	return push(s.client, req)
+}
+
+// encodeWriteRequest encodes the readings as a remote-write protobuf WriteRequest. Every
+// series carries the labels it has on /metrics, and its samples are in time order. Series
+// are labeled with their target even with a single target, whose /metrics series have no
+// target label, so the series of edge agents pushing to one server never collide.
+func encodeWriteRequest(readings []*datakom.Reading) []byte {
+	type series struct {
+		labels  []byte // Encoded Label messages
+		samples []byte // Encoded Sample messages
+	}
+	var order []string
+	index := make(map[string]*series)
+
+	for _, r := range readings {
+		ts := r.Time.UnixMilli()
+		for _, sample := range r.Samples {
+			labels := map[string]string{"__name__": sample.Name}
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			if labels["target"] == "" {
+				labels["target"] = r.Target
+			}
+			for k, v := range sample.Labels {
+				labels[k] = v
+			}
+			// Labels are sorted by name, as the protocol requires
+			names := slices.DeleteFunc(slices.Sorted(maps.Keys(labels)), func(k string) bool { return labels[k] == "" })
+
+			var key strings.Builder
+			for _, k := range names {
+				key.WriteString(k + "\xff" + labels[k] + "\xff")
+			}
+			ser, ok := index[key.String()]
+			if !ok {
+				ser = &series{}
+				for _, k := range names {
+					var l []byte
+					l = protowire.AppendTag(l, 1, protowire.BytesType)
+					l = protowire.AppendString(l, k)
+					l = protowire.AppendTag(l, 2, protowire.BytesType)
+					l = protowire.AppendString(l, labels[k])
+					ser.labels = protowire.AppendTag(ser.labels, 1, protowire.BytesType)
+					ser.labels = protowire.AppendBytes(ser.labels, l)
+				}
+				index[key.String()] = ser
+				order = append(order, key.String())
+			}
+
+			var p []byte
+			p = protowire.AppendTag(p, 1, protowire.Fixed64Type)
+			p = protowire.AppendFixed64(p, math.Float64bits(sample.Value))
+			p = protowire.AppendTag(p, 2, protowire.VarintType)
+			p = protowire.AppendVarint(p, uint64(ts))
+			ser.samples = protowire.AppendTag(ser.samples, 2, protowire.BytesType)
+			ser.samples = protowire.AppendBytes(ser.samples, p)
+		}
+	}
+
+	var b []byte
+	for _, key := range order {
+		ser := index[key]
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, append(ser.labels, ser.samples...))
+	}
+	return b
+}
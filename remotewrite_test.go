@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes the series of a WriteRequest as their labels, k=v in order,
+// followed by their samples as value@milliseconds
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	t.Helper()
+	// fields returns the fields of a message as their numbers and raw values
+	fields := func(b []byte) (nums []protowire.Number, values [][]byte) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			if typ == protowire.BytesType {
+				v, _ := protowire.ConsumeBytes(b)
+				values = append(values, v)
+			} else {
+				values = append(values, b[:n])
+			}
+			nums = append(nums, num)
+			b = b[n:]
+		}
+		return nums, values
+	}
+
+	var out []string
+	nums, values := fields(b)
+	for i, series := range values {
+		if nums[i] != 1 {
+			t.Fatalf("unexpected WriteRequest field %d", nums[i])
+		}
+		var parts []string
+		nums, values := fields(series)
+		for j, v := range values {
+			sub, subValues := fields(v)
+			switch nums[j] {
+			case 1: // Label
+				parts = append(parts, string(subValues[0])+"="+string(subValues[1]))
+			case 2: // Sample
+				if sub[0] != 1 || sub[1] != 2 {
+					t.Fatalf("unexpected sample fields %v", sub)
+				}
+				value, _ := protowire.ConsumeFixed64(subValues[0])
+				ms, _ := protowire.ConsumeVarint(subValues[1])
+				parts = append(parts, fmt.Sprintf("%g@%d", math.Float64frombits(value), ms))
+			}
+		}
+		out = append(out, strings.Join(parts, " "))
+	}
+	return out
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	at := time.UnixMilli(1700000000000)
+	tests := []struct {
+		name     string
+		readings []*datakom.Reading
+		want     []string
+	}{
+		{"labeled with the target", []*datakom.Reading{{Target: "gen-1", Time: at, Samples: []datakom.Sample{
+			{Name: "d500_battery_v", Value: 27.1},
+		}}}, []string{"__name__=d500_battery_v target=gen-1 27.1@1700000000000"}},
+		{"labels sorted", []*datakom.Reading{{Target: "gen-1", Time: at, Labels: map[string]string{"site": "kyiv"}, Samples: []datakom.Sample{
+			{Name: "d500_mains_voltage_v", Labels: map[string]string{"phase": "L1"}, Value: 230},
+		}}}, []string{"__name__=d500_mains_voltage_v phase=L1 site=kyiv target=gen-1 230@1700000000000"}},
+		{"target label kept", []*datakom.Reading{{Target: "tcp://10.0.0.1:502", Time: at, Labels: map[string]string{"target": "gen-1"}, Samples: []datakom.Sample{
+			{Name: "d500_battery_v", Value: 27.1},
+		}}}, []string{"__name__=d500_battery_v target=gen-1 27.1@1700000000000"}},
+		{"empty labels left out", []*datakom.Reading{{Target: "gen-1", Time: at, Labels: map[string]string{"site": ""}, Samples: []datakom.Sample{
+			{Name: "d500_gsm_operator_info", Labels: map[string]string{"operator": ""}, Value: 1},
+		}}}, []string{"__name__=d500_gsm_operator_info target=gen-1 1@1700000000000"}},
+		{"samples of a series in time order", []*datakom.Reading{
+			{Target: "gen-1", Time: at, Samples: []datakom.Sample{{Name: "d500_a", Value: 1}, {Name: "d500_b", Value: 2}}},
+			{Target: "gen-1", Time: at.Add(time.Second), Samples: []datakom.Sample{{Name: "d500_a", Value: 3}}},
+			{Target: "gen-2", Time: at.Add(time.Second), Samples: []datakom.Sample{{Name: "d500_a", Value: 4}}},
+		}, []string{
+			"__name__=d500_a target=gen-1 1@1700000000000 3@1700000001000",
+			"__name__=d500_b target=gen-1 2@1700000000000",
+			"__name__=d500_a target=gen-2 4@1700000001000",
+		}},
+		{"no readings", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeWriteRequest(t, encodeWriteRequest(tt.readings)); !slices.Equal(got, tt.want) {
+				t.Errorf("encodeWriteRequest() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// Framings of serial lines
+const (
+	framingRTU   = "rtu"
+	framingASCII = "ascii"
+)
+
+// validate checks the settings and applies their defaults
+func (sc *SerialConfig) validate() error {
+	if sc.Device == "" {
+		return fmt.Errorf("device is required")
+	}
+	switch sc.Framing {
+	case "":
+		sc.Framing = framingRTU
+	case framingRTU, framingASCII:
+	default:
+		return fmt.Errorf("unknown framing %q, expected rtu or ascii", sc.Framing)
+	}
+	switch sc.Parity {
+	case "":
+		sc.Parity = "none"
+	case "none", "even", "odd":
+	default:
+		return fmt.Errorf("unknown parity %q, expected none, even or odd", sc.Parity)
+	}
+	if sc.Baud == 0 {
+		sc.Baud = 9600
+	}
+	if sc.DataBits == 0 {
+		sc.DataBits = 8
+		if sc.Framing == framingASCII {
+			sc.DataBits = 7
+		}
+	}
+	if sc.StopBits == 0 {
+		sc.StopBits = 1
+		if sc.Parity == "none" {
+			sc.StopBits = 2
+		}
+	}
+	if sc.Baud < 0 {
+		return fmt.Errorf("baud must be positive")
+	}
+	if sc.DataBits != 7 && sc.DataBits != 8 || sc.Framing == framingRTU && sc.DataBits != 8 {
+		return fmt.Errorf("%d data bits not supported with %s framing", sc.DataBits, sc.Framing)
+	}
+	if sc.StopBits != 1 && sc.StopBits != 2 {
+		return fmt.Errorf("stop_bits must be 1 or 2")
+	}
+	return nil
+}
+
+// serialLines serializes the sessions of the targets sharing a serial line, e.g. several
+// controllers on one RS-485 bus, which only one may talk on at a time
+var serialLines = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex // By device
+}{locks: make(map[string]*sync.Mutex)}
+
+// lineClient holds the lock of its serial line while open
+type lineClient struct {
+	datakom.Client
+	line *sync.Mutex
+}
+
+func (c *lineClient) Open() error {
+	c.line.Lock()
+	if err := c.Client.Open(); err != nil {
+		c.line.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *lineClient) Close() error {
+	defer c.line.Unlock()
+	return c.Client.Close()
+}
+
+// newSerialClient returns the client of the controller with the unit ID on the serial line.
+// RTU is spoken by the Modbus package, ASCII by asciiClient.
+func newSerialClient(sc SerialConfig, unitID uint8, timeout time.Duration) (datakom.Client, error) {
+	var client datakom.Client
+	if sc.Framing == framingASCII {
+		client = newASCIIClient(sc, unitID, timeout)
+	} else {
+		parity := map[string]uint{"none": modbus.PARITY_NONE, "even": modbus.PARITY_EVEN, "odd": modbus.PARITY_ODD}[sc.Parity]
+		mc, err := modbus.NewClient(&modbus.ClientConfiguration{
+			URL: "rtu://" + sc.Device, Timeout: timeout,
+			Speed: uint(sc.Baud), DataBits: uint(sc.DataBits), Parity: parity, StopBits: uint(sc.StopBits),
+		})
+		if err != nil {
+			return nil, err
+		}
+		mc.SetUnitId(unitID)
+		client = mc
+	}
+
+	serialLines.Lock()
+	defer serialLines.Unlock()
+	line := serialLines.locks[sc.Device]
+	if line == nil {
+		line = new(sync.Mutex)
+		serialLines.locks[sc.Device] = line
+	}
+	return &lineClient{client, line}, nil
+}
+
+// Read timeout of the serial port, within which the deadline of a response is checked
+const asciiReadTimeout = 50 * time.Millisecond
+
+// Errors of the Modbus exception codes
+var asciiExceptions = map[byte]error{
+	0x01: modbus.ErrIllegalFunction,
+	0x02: modbus.ErrIllegalDataAddress,
+	0x03: modbus.ErrIllegalDataValue,
+	0x04: modbus.ErrServerDeviceFailure,
+	0x05: modbus.ErrAcknowledge,
+	0x06: modbus.ErrServerDeviceBusy,
+	0x08: modbus.ErrMemoryParityError,
+	0x0a: modbus.ErrGWPathUnavailable,
+	0x0b: modbus.ErrGWTargetFailedToRespond,
+}
+
+// asciiClient speaks Modbus ASCII, which the Modbus package lacks, for legacy serial
+// converters: a frame is sent as hex digits between a colon and CR LF, checked by a
+// longitudinal redundancy check (LRC) instead of the CRC of RTU
+type asciiClient struct {
+	config  serial.Config
+	unitID  uint8
+	timeout time.Duration // Of every request
+	open    func(*serial.Config) (serial.Port, error)
+	port    serial.Port
+}
+
+func newASCIIClient(sc SerialConfig, unitID uint8, timeout time.Duration) *asciiClient {
+	return &asciiClient{
+		config: serial.Config{
+			Address:  sc.Device,
+			BaudRate: sc.Baud,
+			DataBits: sc.DataBits,
+			StopBits: sc.StopBits,
+			Parity:   strings.ToUpper(sc.Parity[:1]),
+			Timeout:  asciiReadTimeout,
+		},
+		unitID:  unitID,
+		timeout: timeout,
+		open:    serial.Open,
+	}
+}
+
+func (c *asciiClient) Open() error {
+	port, err := c.open(&c.config)
+	if err != nil {
+		return err
+	}
+	c.port = port
+	return nil
+}
+
+func (c *asciiClient) Close() error {
+	if c.port == nil {
+		return nil
+	}
+	err := c.port.Close()
+	c.port = nil
+	return err
+}
+
+// ReadRegisters reads holding registers with function code 3, or input registers with 4
+func (c *asciiClient) ReadRegisters(addr, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	if quantity == 0 || quantity > 125 {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+	fc := byte(0x03)
+	if regType == modbus.INPUT_REGISTER {
+		fc = 0x04
+	}
+	resp, err := c.transact(fc, binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, addr), quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 1+2*int(quantity) || int(resp[0]) != 2*int(quantity) {
+		return nil, modbus.ErrProtocolError
+	}
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(resp[1+2*i:])
+	}
+	return values, nil
+}
+
+func (c *asciiClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	values, err := c.ReadRegisters(addr, 1, regType)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// WriteRegister writes a holding register with function code 6, which the controller echoes
+func (c *asciiClient) WriteRegister(addr, value uint16) error {
+	req := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, addr), value)
+	resp, err := c.transact(0x06, req)
+	if err != nil {
+		return err
+	}
+	if string(resp) != string(req) {
+		return modbus.ErrProtocolError
+	}
+	return nil
+}
+
+// transact sends a request to the unit and returns the data of its response
+func (c *asciiClient) transact(fc byte, data []byte) ([]byte, error) {
+	if c.port == nil {
+		return nil, errors.New("serial port not open")
+	}
+	if _, err := c.port.Write(encodeASCIIFrame(append([]byte{c.unitID, fc}, data...))); err != nil {
+		return nil, err
+	}
+	pdu, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(pdu) < 2:
+		return nil, modbus.ErrShortFrame
+	case pdu[0] != c.unitID:
+		return nil, modbus.ErrBadUnitId
+	case pdu[1] == fc:
+		return pdu[2:], nil
+	case pdu[1] == fc|0x80 && len(pdu) == 3:
+		if err, ok := asciiExceptions[pdu[2]]; ok {
+			return nil, err
+		}
+	}
+	return nil, modbus.ErrProtocolError
+}
+
+// readFrame reads the next frame from the port, skipping anything before its colon, and
+// returns its checked contents without the LRC
+func (c *asciiClient) readFrame() ([]byte, error) {
+	deadline := time.Now().Add(c.timeout)
+	var buf []byte
+	chunk := make([]byte, 256)
+	for {
+		n, err := c.port.Read(chunk)
+		if err != nil && err != serial.ErrTimeout {
+			return nil, err
+		}
+		buf = append(buf, chunk[:n]...)
+		if start := strings.IndexByte(string(buf), ':'); start >= 0 {
+			buf = buf[start:]
+			if end := strings.Index(string(buf), "\r\n"); end >= 0 {
+				return decodeASCIIFrame(buf[1:end])
+			}
+		} else {
+			buf = buf[:0]
+		}
+		if time.Now().After(deadline) {
+			return nil, modbus.ErrRequestTimedOut
+		}
+	}
+}
+
+// encodeASCIIFrame frames the unit ID, function code and data with their LRC
+func encodeASCIIFrame(pdu []byte) []byte {
+	var lrc byte
+	for _, b := range pdu {
+		lrc += b
+	}
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(append(pdu, -lrc))) + "\r\n")
+}
+
+// decodeASCIIFrame decodes the hex digits between the colon and CR LF of a frame, checking
+// that they sum up to zero with the LRC
+func decodeASCIIFrame(digits []byte) ([]byte, error) {
+	pdu := make([]byte, hex.DecodedLen(len(digits)))
+	if _, err := hex.Decode(pdu, digits); err != nil || len(pdu) < 1 {
+		return nil, modbus.ErrProtocolError
+	}
+	var sum byte
+	for _, b := range pdu {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, modbus.ErrBadCRC
+	}
+	return pdu[:len(pdu)-1], nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// asciiPort is a serial port answering the ASCII frames written to it with respond
+type asciiPort struct {
+	respond func(pdu []byte) []byte // Raw bytes sent back, nil for no answer
+	pending []byte
+}
+
+func (p *asciiPort) Open(*serial.Config) error { return nil }
+func (p *asciiPort) Close() error              { return nil }
+
+func (p *asciiPort) Write(b []byte) (int, error) {
+	pdu, err := decodeASCIIFrame(b[1 : len(b)-2])
+	if err != nil {
+		return 0, err
+	}
+	p.pending = append(p.pending, p.respond(pdu)...)
+	return len(b), nil
+}
+
+func (p *asciiPort) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		time.Sleep(time.Millisecond)
+		return 0, serial.ErrTimeout
+	}
+	// A few bytes at a time, as the line delivers them
+	n := copy(b[:min(len(b), 5)], p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// simulatorResponder answers register reads from the simulator of the profile
+func simulatorResponder(sim *datakom.Simulator) func(pdu []byte) []byte {
+	return func(pdu []byte) []byte {
+		unit, fc := pdu[0], pdu[1]
+		addr, quantity := binary.BigEndian.Uint16(pdu[2:]), binary.BigEndian.Uint16(pdu[4:])
+		var values []uint16
+		var err error
+		switch fc {
+		case 0x03:
+			values, err = sim.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: unit, Addr: addr, Quantity: quantity})
+		case 0x04:
+			values, err = sim.HandleInputRegisters(&modbus.InputRegistersRequest{UnitId: unit, Addr: addr, Quantity: quantity})
+		default:
+			err = modbus.ErrIllegalFunction
+		}
+		if err != nil {
+			code := byte(0x04)
+			for c, e := range asciiExceptions {
+				if errors.Is(err, e) {
+					code = c
+				}
+			}
+			return encodeASCIIFrame([]byte{unit, fc | 0x80, code})
+		}
+		resp := []byte{unit, fc, byte(2 * len(values))}
+		for _, v := range values {
+			resp = binary.BigEndian.AppendUint16(resp, v)
+		}
+		return encodeASCIIFrame(resp)
+	}
+}
+
+// newTestASCIIClient returns an ASCII client of unit 1 talking to the port
+func newTestASCIIClient(port *asciiPort) *asciiClient {
+	c := newASCIIClient(SerialConfig{Device: "/dev/null", Framing: framingASCII, Parity: "none"}, 1, 100*time.Millisecond)
+	c.open = func(*serial.Config) (serial.Port, error) { return port, nil }
+	return c
+}
+
+func TestASCIIClientPoll(t *testing.T) {
+	profile, err := datakom.Lookup("d500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestASCIIClient(&asciiPort{respond: simulatorResponder(datakom.NewSimulator(profile))})
+	reading, err := datakom.NewCollector(client, "serial", profile).Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range reading.Samples {
+		if s.Name == "d500_block_read_success" && s.Value != 1 {
+			t.Errorf("block %s: read failed", s.Labels["block"])
+		}
+		if s.Name == "d500_fuel_percent" {
+			found = true
+			if math.Abs(s.Value-80) > 0.1 {
+				t.Errorf("fuel_percent = %g, want 80", s.Value)
+			}
+		}
+	}
+	if !found {
+		t.Error("fuel_percent not read")
+	}
+}
+
+func TestASCIIClientFrames(t *testing.T) {
+	// Read of holding register 0 of unit 1, from the Modbus serial line specification
+	if got := string(encodeASCIIFrame([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01})); got != ":010300000001FB\r\n" {
+		t.Errorf("encodeASCIIFrame() = %q, want \":010300000001FB\\r\\n\"", got)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		want     error
+	}{
+		{"value", "noise:0103020915DC\r\n", nil},
+		{"exception", ":0183027A\r\n", modbus.ErrIllegalDataAddress},
+		{"bad LRC", ":0103020915DD\r\n", modbus.ErrBadCRC},
+		{"other unit", ":0203020915DB\r\n", modbus.ErrBadUnitId},
+		{"no answer", "", modbus.ErrRequestTimedOut},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestASCIIClient(&asciiPort{respond: func([]byte) []byte { return []byte(tt.response) }})
+			if err := c.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			v, err := c.ReadRegister(10240, modbus.HOLDING_REGISTER)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ReadRegister() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && v != 0x0915 {
+				t.Errorf("ReadRegister() = %#x, want 0x0915", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// runSimulator implements the simulator subcommand
+func runSimulator(args []string) {
+	fs := flag.NewFlagSet("simulator", flag.ExitOnError)
+	listen := fs.String("listen", getEnv("SIMULATOR_LISTEN", "127.0.0.1:5020"), "Address to serve Modbus TCP on")
+	model := fs.String("device.model", getEnv("DATAKOM_MODEL", "d500"), "Controller model to simulate (d300, d500, d700, dkg507, dkg509)")
+	fs.Parse(args)
+
+	profile, err := datakom.Lookup(*model)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Like the controller, a single client connection is accepted at a time
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL: "tcp://" + *listen, Timeout: 30 * time.Second, MaxClients: 1,
+	}, datakom.NewSimulator(profile))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Simulating %s on %s", profile.Model, *listen)
+	select {}
+}
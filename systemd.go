@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state change, e.g. READY=1, to the service manager when started by
+// systemd with Type=notify, and does nothing otherwise
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Names starting with @ are in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog returns the watchdog timeout set by WatchdogSec= of the unit, or zero if the
+// systemd watchdog is disabled for this process
+func sdWatchdog() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// runWatchdog pings the systemd watchdog at half its timeout while the background polls of
+// every target keep completing, so systemd restarts the exporter when polling hangs
+func runWatchdog(set *targetSet, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if stalled := set.stalled(); stalled != "" {
+			log.Printf("Polling of %s stalled, no longer pinging the systemd watchdog", stalled)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Failed to ping the systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/qveensi/datakom_exporter/pkg/datakom"
+	"github.com/simonvetter/modbus"
+)
+
+// newTargetCollector builds the Modbus client and collector of a configured target
+func newTargetCollector(t TargetConfig, cfg *Config, defaultModel string) (*datakom.Collector, error) {
+	if t.Serial != nil {
+		if t.Host != "" || t.TLS != nil {
+			return nil, fmt.Errorf("serial targets take no host or tls")
+		}
+		if err := t.Serial.validate(); err != nil {
+			return nil, fmt.Errorf("invalid serial settings: %w", err)
+		}
+	} else if t.Host = hostname(t.Host); t.Host == "" {
+		return nil, fmt.Errorf("host or serial is required")
+	}
+	if t.Port == 0 {
+		t.Port = 502
+		if t.TLS != nil {
+			t.Port = 802
+		}
+	}
+	if t.UnitID == 0 {
+		t.UnitID = 1 // Standard Modbus Address for Datakom devices
+	}
+	if t.Model == "" {
+		t.Model = defaultModel
+	}
+	retry := cfg.Retry
+	if t.Retry != nil {
+		retry = *t.Retry
+	}
+	if retry.Attempts < 0 {
+		return nil, fmt.Errorf("retry attempts must not be negative")
+	}
+	if retry.Attempts == 0 {
+		retry.Attempts = 1
+	}
+	if retry.Delay == 0 {
+		retry.Delay = 200 * time.Millisecond
+	}
+	if retry.MaxDelay == 0 {
+		retry.MaxDelay = 5 * time.Second
+	}
+
+	rating := cfg.Rating
+	if t.Rating != nil {
+		rating = *t.Rating
+	}
+	if err := rating.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rating: %w", err)
+	}
+	fuel := cfg.Fuel
+	if t.Fuel != nil {
+		fuel = *t.Fuel
+	}
+	if err := fuel.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fuel settings: %w", err)
+	}
+	service := cfg.Service
+	if t.Service != nil {
+		service = *t.Service
+	}
+	if err := service.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid service settings: %w", err)
+	}
+
+	mb := cfg.Modbus.merge(t.Modbus)
+	if mb.MaxReadSize > 125 {
+		return nil, fmt.Errorf("modbus max_read_size must be at most 125")
+	}
+	if mb.Timeout < 0 || mb.RequestDelay < 0 || mb.MinInterval < 0 {
+		return nil, fmt.Errorf("modbus timeout, request_delay and min_interval must not be negative")
+	}
+	if mb.Timeout == 0 {
+		mb.Timeout = 5 * time.Second
+	}
+	maxGap := uint16(16)
+	if mb.MaxGap != nil {
+		maxGap = *mb.MaxGap
+	}
+
+	watchdog := cfg.Watchdog
+	if t.Watchdog != nil {
+		watchdog = *t.Watchdog
+	}
+	if err := watchdog.validate(); err != nil {
+		return nil, fmt.Errorf("invalid watchdog: %w", err)
+	}
+
+	profile, err := datakom.Lookup(t.Model)
+	if err != nil {
+		return nil, err
+	}
+	if profile, err = configureProfile(profile, cfg, t.Blocks); err != nil {
+		return nil, err
+	}
+
+	name := t.Name
+	var client datakom.Client
+	if t.Serial != nil {
+		if client, err = newSerialClient(*t.Serial, t.UnitID, mb.Timeout); err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = t.Serial.Device
+		}
+	} else {
+		// Initialize Modbus TCP client. The connection is opened for every session, so host
+		// names are resolved again on each reconnect and address changes are followed.
+		hostPort := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+		address := "tcp://" + hostPort
+		clientConf := &modbus.ClientConfiguration{URL: address, Timeout: mb.Timeout}
+		if t.TLS != nil {
+			if err := configureTLS(clientConf, t.TLS); err != nil {
+				return nil, err
+			}
+			address = "tcp+tls://" + hostPort
+			clientConf.URL = address
+		}
+		mc, err := modbus.NewClient(clientConf)
+		if err != nil {
+			return nil, err
+		}
+		mc.SetUnitId(t.UnitID)
+		client = mc
+
+		if name == "" {
+			name = address
+			if cfg.Targets != nil {
+				name = hostPort
+			}
+		}
+	}
+	c := datakom.NewCollector(client, name, profile)
+	c.Retry = retry
+	c.Rating = rating
+	c.Fuel = fuel
+	c.Service = service
+	c.MaxGap = maxGap
+	c.MaxReadSize = mb.MaxReadSize
+	c.RequestDelay = mb.RequestDelay
+	c.MinInterval = mb.MinInterval
+	c.FailureThreshold = watchdog.Failures
+	if watchdog.Webhook != nil {
+		c.OnFailures = watchdog.Webhook.failureHook(name, watchdog.Failures)
+	}
+	return c, nil
+}
+
+// configureTLS loads the client certificate and CAs of a Modbus/TCP Security target
+func configureTLS(conf *modbus.ClientConfiguration, tc *TLSConfig) error {
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return fmt.Errorf("tls requires cert_file and key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading client certificate: %w", err)
+	}
+	conf.TLSClientCert = &cert
+	if tc.CAFile != "" {
+		if conf.TLSRootCAs, err = modbus.LoadCertPool(tc.CAFile); err != nil {
+			return fmt.Errorf("loading CAs: %w", err)
+		}
+	}
+	return nil
+}
+
+// hostname strips the brackets of an IPv6 literal, e.g. [fd00::10], for joining with a port
+func hostname(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// mergeTargetLabels returns the constant labels of every target: the global labels with
+// the target's own merged over them. Every target carries the same label names, so metrics
+// of the same name have consistent dimensions across targets.
+func mergeTargetLabels(global map[string]string, targets []TargetConfig) []map[string]string {
+	sets := make([]map[string]string, len(targets))
+	for i, t := range targets {
+		sets[i] = make(map[string]string)
+		for name, value := range global {
+			sets[i][name] = value
+		}
+		for name, value := range t.Labels {
+			sets[i][name] = value
+		}
+	}
+	for _, set := range sets {
+		for _, other := range sets {
+			for name := range other {
+				if _, ok := set[name]; !ok {
+					set[name] = ""
+				}
+			}
+		}
+	}
+	return sets
+}
+
+// target is a polled controller with its constant labels and a private registry
+// serving /metrics?target=<name>, and merged with the other targets /metrics
+type target struct {
+	collector *datakom.Collector
+	labels    map[string]string
+	registry  *prometheus.Registry
+	telemetry *prometheus.Registry // Modbus link metrics, if served separately
+	added     time.Time
+}
+
+// targetSet holds the targets served by the exporter, in configuration order;
+// discovered targets are added and removed at runtime
+type targetSet struct {
+	mu      sync.RWMutex
+	names   []string
+	targets map[string]*target
+
+	metricsHandler   http.Handler // Serves the default registry and all targets
+	telemetryHandler http.Handler // Serves the default registry and the Modbus link metrics
+
+	// The exporter's own metrics and the Modbus link metrics are served by telemetryHandler
+	// alone, rather than along with the device metrics
+	separateTelemetry bool
+
+	// Background polling applied to every added target; disabled when zero
+	pollInterval time.Duration
+	maxAge       time.Duration // Age of background readings no longer served
+	sinks        []datakom.Sink
+}
+
+func newTargetSet() *targetSet {
+	s := &targetSet{targets: make(map[string]*target)}
+	s.metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.GathererFunc(s.gather), promhttp.HandlerOpts{}))
+	s.telemetryHandler = promhttp.HandlerFor(prometheus.GathererFunc(s.gatherTelemetry), promhttp.HandlerOpts{})
+	return s
+}
+
+// gather collects the exporter's own metrics from the default registry and those of every
+// target from its private registry. Targets are not registered in the default registry, as
+// it would pin the label names of their metrics for the lifetime of the process.
+func (s *targetSet) gather() ([]*dto.MetricFamily, error) {
+	s.mu.RLock()
+	var g prometheus.Gatherers
+	if !s.separateTelemetry {
+		g = append(g, prometheus.DefaultGatherer)
+	}
+	for _, name := range s.names {
+		g = append(g, s.targets[name].registry)
+	}
+	s.mu.RUnlock()
+	return g.Gather()
+}
+
+// gatherTelemetry collects the exporter's own metrics and, if served separately, the Modbus
+// link metrics of every target
+func (s *targetSet) gatherTelemetry() ([]*dto.MetricFamily, error) {
+	s.mu.RLock()
+	g := prometheus.Gatherers{prometheus.DefaultGatherer}
+	for _, name := range s.names {
+		if t := s.targets[name]; t.telemetry != nil {
+			g = append(g, t.telemetry)
+		}
+	}
+	s.mu.RUnlock()
+	return g.Gather()
+}
+
+// add registers the collector with its constant labels in a private registry
+func (s *targetSet) add(c *datakom.Collector, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.targets[c.Name()]; ok {
+		return fmt.Errorf("duplicate target %q", c.Name())
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+
+	c.Labels = labels
+	c.MaxAge = s.maxAge
+	t := &target{collector: c, labels: labels, registry: prometheus.NewRegistry(), added: time.Now()}
+	if s.separateTelemetry {
+		c.SeparateLink = true
+		t.telemetry = prometheus.NewRegistry()
+		if err := prometheus.WrapRegistererWith(labels, t.telemetry).Register(c.Link()); err != nil {
+			return err
+		}
+	}
+	if err := prometheus.WrapRegistererWith(labels, t.registry).Register(c); err != nil {
+		return err
+	}
+	s.names = append(s.names, c.Name())
+	s.targets[c.Name()] = t
+	if s.pollInterval > 0 {
+		c.StartPolling(s.pollInterval, s.sinks)
+	}
+	return nil
+}
+
+// remove stops polling and drops the named target
+func (s *targetSet) remove(name string) {
+	s.mu.Lock()
+	t, ok := s.targets[name]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.targets, name)
+	s.names = slices.DeleteFunc(s.names, func(n string) bool { return n == name })
+	s.mu.Unlock()
+
+	// Outside the lock, as a poll in progress may take a while; the replacement of the
+	// target is added only once it is no longer polled
+	t.collector.StopPolling()
+}
+
+// stalled returns the name of a target polled in the background whose latest reading is
+// older than maxAge, or "" while polling keeps up
+func (s *targetSet) stalled() string {
+	if s.pollInterval == 0 {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, name := range s.names {
+		t := s.targets[name]
+		if t.collector.Reading() == nil && time.Since(t.added) > s.maxAge {
+			return name
+		}
+	}
+	return ""
+}
+
+// get returns the named target, or nil
+func (s *targetSet) get(name string) *target {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.targets[name]
+}
+
+// len returns the number of registered targets
+func (s *targetSet) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.names)
+}
+
+// lookup returns the target selected by the target query parameter, which may be
+// omitted when only one target is configured
+func (s *targetSet) lookup(req *http.Request) (*target, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := req.URL.Query().Get("target")
+	if name == "" && len(s.names) == 1 {
+		name = s.names[0]
+	}
+	t, ok := s.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", name)
+	}
+	return t, nil
+}
+
+// handler dispatches a request to the collector of the selected target
+func (s *targetSet) handler(h func(*datakom.Collector, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		t, err := s.lookup(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h(t.collector, w, req)
+	}
+}
+
+// serveMetrics exposes all targets, or only the one named by ?target=<name>
+func (s *targetSet) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if !req.URL.Query().Has("target") {
+		s.metricsHandler.ServeHTTP(w, req)
+		return
+	}
+	t, err := s.lookup(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	promhttp.HandlerFor(t.registry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
+
+// sdGroup is a target group in the Prometheus HTTP service discovery format
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// serveSD lists the targets for Prometheus HTTP service discovery. Each group points at
+// this exporter and selects its controller with the target URL parameter; the constant
+// labels are already attached to the series and are offered as meta labels only, so they
+// do not clash with the scraped ones.
+func (s *targetSet) serveSD(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	groups := make([]sdGroup, 0, len(s.names))
+	for _, name := range s.names {
+		t := s.targets[name]
+		labels := map[string]string{
+			"__param_target":        name,
+			"__meta_datakom_target": name,
+			"__meta_datakom_model":  t.collector.Profile().Model,
+		}
+		for k, v := range t.labels {
+			if k != "target" {
+				labels["__meta_datakom_label_"+k] = v
+			}
+		}
+		groups = append(groups, sdGroup{Targets: []string{req.Host}, Labels: labels})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// readings returns the latest readings of all targets, or only the one named by ?target=<name>
+func (s *targetSet) readings(req *http.Request) ([]*datakom.Reading, error) {
+	var targets []*target
+	if req.URL.Query().Has("target") {
+		t, err := s.lookup(req)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	} else {
+		s.mu.RLock()
+		for _, name := range s.names {
+			targets = append(targets, s.targets[name])
+		}
+		s.mu.RUnlock()
+	}
+
+	// Targets not polled in the background are polled concurrently
+	readings := make([]*datakom.Reading, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readings[i] = t.collector.Reading()
+		}()
+	}
+	wg.Wait()
+	return slices.DeleteFunc(readings, func(r *datakom.Reading) bool { return r == nil }), nil
+}
+
+// serveReadings returns the latest decoded values of all targets, or only the one
+// named by ?target=<name>, as JSON
+func (s *targetSet) serveReadings(w http.ResponseWriter, req *http.Request) {
+	readings, err := s.readings(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Readings []*datakom.Reading `json:"readings"`
+	}{readings})
+}
+
+// serveInflux returns the latest readings of all targets, or only the one named by
+// ?target=<name>, in InfluxDB line protocol
+func (s *targetSet) serveInflux(w http.ResponseWriter, req *http.Request) {
+	readings, err := s.readings(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, r := range readings {
+		w.Write(appendLineProtocol(nil, r))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WatchdogConfig fires after consecutive failed polls, and optionally power-cycles the
+// link, e.g. through a smart plug or the API of the LTE router
+type WatchdogConfig struct {
+	Failures int            `yaml:"failures"` // Consecutive failed polls before firing, 0 (default) disables the watchdog
+	Webhook  *WebhookConfig `yaml:"webhook"`  // Called when the watchdog fires, backing off while the target stays down
+}
+
+// WebhookConfig is an HTTP request notifying of a target that keeps failing
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"` // Defaults to POST
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"` // Defaults to 10s
+}
+
+// validate checks the settings and applies their defaults
+func (w *WatchdogConfig) validate() error {
+	if w.Failures < 0 {
+		return fmt.Errorf("failures must not be negative")
+	}
+	if w.Webhook == nil {
+		return nil
+	}
+	if w.Failures == 0 {
+		return fmt.Errorf("webhook requires failures")
+	}
+	wh := *w.Webhook
+	if wh.URL == "" {
+		return fmt.Errorf("webhook url is required")
+	}
+	if wh.Method == "" {
+		wh.Method = http.MethodPost
+	}
+	if wh.Timeout == 0 {
+		wh.Timeout = 10 * time.Second
+	}
+	w.Webhook = &wh
+	return nil
+}
+
+// failureHook returns the watchdog callback of a target calling the webhook, which
+// receives the target and its failed polls as JSON. While the target stays down, the
+// webhook is called the 1st, 2nd, 4th, 8th... time the watchdog fires, so that a controller
+// that is switched off does not power-cycle the link every few polls. It is called
+// asynchronously so that polling goes on while the link is power-cycled.
+func (wh *WebhookConfig) failureHook(target string, after int) func(failures int) {
+	client := &http.Client{Timeout: wh.Timeout}
+	return func(failures int) {
+		if n := failures / after; n&(n-1) != 0 {
+			return
+		}
+		body, _ := json.Marshal(struct {
+			Target   string `json:"target"`
+			Failures int    `json:"failures"`
+		}{target, failures})
+		go func() {
+			req, err := http.NewRequest(wh.Method, wh.URL, bytes.NewReader(body))
+			if err != nil {
+				log.Printf("Failed to call watchdog webhook of %s: %v", target, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range wh.Headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Failed to call watchdog webhook of %s: %v", target, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("Watchdog webhook of %s returned %s", target, resp.Status)
+				return
+			}
+			log.Printf("Called watchdog webhook of %s", target)
+		}()
+	}
+}